@@ -5,8 +5,12 @@ ip = "0.0.0.0"
 port = 9000
 secure = false
 
-user = "www-nobody"
-group = "www-nobody"
+// Run every task command as this user and group unless its task sets its
+// own.  Unlike webhook's -setuid and -setgid, which drop the privileges of
+// the whole process, the service keeps its own and switches credentials for
+// each command only, so it must run as root to use them.
+// user = "nobody"
+// group = "nogroup"
 
 logfile = "foo.log"
 nopanic = true
@@ -23,10 +27,41 @@ xrequestid_limit = 32
 
 proxy_protocol = true
 
+max_request_size = "10MiB" // larger bodies are answered with 413
+read_timeout = "1m"        // to read a request, including its body
+
+// The job status API at /_jobs/<id> reports the state and output of
+// asynchronous jobs.  It is disabled unless jobs_token is set; clients send
+// the token as "Authorization: Bearer <token>".
+job_history = 100
+// jobs_token = getenv("WEBHOOK_JOBS_TOKEN")
+
+max_concurrency = 8 // task commands running at once across all hooks
+queue_size = 100
+queue_timeout = "1m"
+queue_policy = "queue" // or "reject" to answer 503 at once
+
 // Keep?
 http_methods = ["POST"]
 
+// Reload when the configuration files change, as well as on SIGHUP.  The
+// listener, read_timeout, logfile, async_workers and job_history need a
+// restart.
+hotreload = true
+
 hook "PREFIX/webhook/{scan_id}" {
+  // Requests arriving while a run is queued share that run's result;
+  // "reject" answers 429 instead.
+  max_concurrency = 1
+  queue_policy = "coalesce"
+
+  // Run once per repository after 10s without further pushes, using the
+  // latest payload; the superseded requests receive its result.
+  debounce {
+    window = "10s"
+    key = payload("repository.full_name") // optional
+  }
+
   constraints = [ // trigger-rule
     or(
       eq(getenv("FOO"), ""),
@@ -90,12 +125,32 @@ hook "PREFIX/webhook/{scan_id}" {
 
     workdir = "/home/adnan/go" // command-working-directory
 
+    // async = true // respond at once; result then holds zero values
+    timeout = "5m"
+    kill_grace_period = "10s"
+
+    // user = "deploy" // overrides the service user and group
+
+    limits {
+      memory = "512MiB"
+      cpu_time = "1m"
+      open_files = 256
+      // RLIMIT_NPROC: counts every process of the command's user, not
+      // just those of this task, and is not enforced for root.
+      processes = 64
+      output = "1MiB" // per output stream; defaults to 1MiB
+      stderr = "64KiB" // overrides output; also stdout and combined
+      keep_output = "tail" // or "head"; sets result.truncated
+      clear_env = true // only env_vars and file variables are passed
+    }
+
     env_vars = { // pass-environment-to-command
       EVENT_NAME = payload("a")
     }
 
-    // pass-file-to-command - FIXME not sure how to define this yet...
-    pass_file {
+    // pass-file-to-command; file blocks may be repeated and the path of
+    // each file is available as files.<label>.path
+    pass_file "zip" {
       source = "payload"
       name = "zippedBinary"
       filename = "binaryFile.zip"
@@ -103,14 +158,11 @@ hook "PREFIX/webhook/{scan_id}" {
       envname = "ENV_VAR"
       keep = false
     }
-    create_file {
-      // FIXME - HCL doesn't handle binary data very well.
-      // This may not be workable.
-      // content = base64decode(payload("zippedBinary"))
-      content = [0]
+    create_file "zip_copy" {
+      content = base64decode(payload("zippedBinary"))
       filename = "binaryFile.zip"
       keep = false
-      envname = "ENV_VAR"
+      envname = "ZIP_COPY"
     }
   }
 
@@ -120,6 +172,11 @@ hook "PREFIX/webhook/{scan_id}" {
       headers = { // response-headers
           Strict-Transport-Security = "max-age=63072000; includeSubDomains",
       }
+      content_type = "application/json"
+      // unsatisfied.reasons holds the location and value of each failed
+      // constraint.  Requests may come from anyone, so it is not echoed
+      // here; the failed expressions are logged in verbose mode.
+      body = "Hook rules were not satisfied."
     }
 
     success {
@@ -129,17 +186,26 @@ hook "PREFIX/webhook/{scan_id}" {
           Strict-Transport-Security = "max-age=63072000; includeSubDomains",
       }
       content_type = "application/json"
-      body = result.CombinedOutput // include-command-output-in-response
+      body = result.combined // include-command-output-in-response
+
+      // Send stdout while the command runs instead of rendering this
+      // block.  Clients accepting text/event-stream receive Server-Sent
+      // Events ending with a "result" event; others receive a chunked body
+      // with Webhook-Exit-Code, Webhook-Status and Webhook-Truncated
+      // trailers.  It is an error with an async task.
+      stream = false
     }
 
     error {
-      status_code = result.exit_code
+      status_code = result.timed_out ? 504 : result.exit_code
       headers = { // response-headers
           name = result.pid,
+          // Nanoseconds, like the values of duration() and since().
+          X-Slow = result.duration > duration("10s"),
           Strict-Transport-Security = "max-age=63072000; includeSubDomains",
       }
       content_type = "application/json"
-      body = result.CombinedOutput // include-command-output-in-response
+      body = result.combined // include-command-output-in-response
     }
   }
 }
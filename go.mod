@@ -9,5 +9,6 @@ require (
 	github.com/hashicorp/hcl/v2 v2.16.1
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
 	github.com/zclconf/go-cty v1.13.0
+	golang.org/x/sys v0.7.0
 	golang.org/x/text v0.7.0 // indirect
 )
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Bytes is a capsule type holding raw binary data.  Unlike strings, bytes
+// values need not be valid UTF-8 and are never normalized, so they pass
+// binary data through expressions unchanged.
+//
+// Bytes values convert to strings if they hold valid UTF-8, and strings
+// convert to bytes, so bytes may be passed to functions and attributes
+// expecting strings.
+var Bytes = cty.CapsuleWithOps("bytes", reflect.TypeOf([]byte(nil)), &cty.CapsuleOps{
+	GoString: func(v interface{}) string {
+		return fmt.Sprintf("config.BytesVal(%#v)", *v.(*[]byte))
+	},
+	TypeGoString: func(ty reflect.Type) string {
+		return "config.Bytes"
+	},
+	Equals: func(a, b interface{}) cty.Value {
+		return cty.BoolVal(bytes.Equal(*a.(*[]byte), *b.(*[]byte)))
+	},
+	RawEquals: func(a, b interface{}) bool {
+		return bytes.Equal(*a.(*[]byte), *b.(*[]byte))
+	},
+	ConversionFrom: func(dst cty.Type) func(interface{}, cty.Path) (cty.Value, error) {
+		if dst != cty.String {
+			return nil
+		}
+		return func(v interface{}, path cty.Path) (cty.Value, error) {
+			b := *v.(*[]byte)
+			if !utf8.Valid(b) {
+				return cty.NilVal, path.NewErrorf("bytes value is not valid UTF-8 and cannot be used as a string")
+			}
+			return cty.StringVal(string(b)), nil
+		}
+	},
+	ConversionTo: func(src cty.Type) func(cty.Value, cty.Path) (interface{}, error) {
+		if src != cty.String {
+			return nil
+		}
+		return func(v cty.Value, path cty.Path) (interface{}, error) {
+			b := []byte(v.AsString())
+			return &b, nil
+		}
+	},
+})
+
+// BytesVal returns a Bytes value holding b.  The caller must not modify b
+// afterward.
+func BytesVal(b []byte) cty.Value {
+	if b == nil {
+		b = []byte{}
+	}
+	return cty.CapsuleVal(Bytes, &b)
+}
+
+// AsBytes returns the raw data of a Bytes or string value.  A list or tuple of
+// numbers is also accepted, with each element holding a single byte.
+func AsBytes(v cty.Value) ([]byte, error) {
+	if v.IsNull() {
+		return nil, fmt.Errorf("value is null")
+	}
+	if !v.IsWhollyKnown() {
+		return nil, fmt.Errorf("value is unknown")
+	}
+
+	ty := v.Type()
+	switch {
+	case ty.Equals(Bytes):
+		return *v.EncapsulatedValue().(*[]byte), nil
+	case ty == cty.String:
+		return []byte(v.AsString()), nil
+	case ty.IsListType(), ty.IsTupleType():
+		b := make([]byte, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, ev := it.Element()
+			if ev.IsNull() || ev.Type() != cty.Number {
+				return nil, fmt.Errorf("byte sequences must only contain numbers")
+			}
+			n, acc := ev.AsBigFloat().Int64()
+			if acc != 0 || n < 0 || n > 255 {
+				return nil, fmt.Errorf("byte value %s out of range", ev.AsBigFloat().String())
+			}
+			b = append(b, byte(n))
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("%s value cannot be used as bytes", ty.FriendlyName())
+	}
+}
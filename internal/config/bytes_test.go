@@ -0,0 +1,160 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+func TestBytesConversion(t *testing.T) {
+	tests := []struct {
+		name string
+		v    cty.Value
+		to   cty.Type
+		want cty.Value
+		err  string // empty if the conversion succeeds
+	}{
+		{"bytes to string", BytesVal([]byte("héllo")), cty.String, cty.StringVal("héllo"), ""},
+		{"empty bytes to string", BytesVal(nil), cty.String, cty.StringVal(""), ""},
+		{"invalid UTF-8 to string", BytesVal([]byte{0xff, 0x00}), cty.String, cty.NilVal, "not valid UTF-8"},
+		{"string to bytes", cty.StringVal("héllo"), Bytes, BytesVal([]byte("héllo")), ""},
+		{"bytes to number", BytesVal([]byte("1")), cty.Number, cty.NilVal, "number required"},
+		{"number to bytes", cty.NumberIntVal(1), Bytes, cty.NilVal, "bytes required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convert.Convert(tt.v, tt.to)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %#v, want error %q", got, tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.RawEquals(tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		v    cty.Value
+		want string
+		err  string // empty if the value is accepted
+	}{
+		{"bytes", BytesVal([]byte{0xff, 0x00}), "\xff\x00", ""},
+		{"string", cty.StringVal("abc"), "abc", ""},
+		{"tuple", cty.TupleVal([]cty.Value{cty.NumberIntVal(104), cty.NumberIntVal(105)}), "hi", ""},
+		{"list", cty.ListVal([]cty.Value{cty.NumberIntVal(255)}), "\xff", ""},
+		{"out of range", cty.TupleVal([]cty.Value{cty.NumberIntVal(256)}), "", "byte value 256 out of range"},
+		{"fraction", cty.TupleVal([]cty.Value{cty.NumberFloatVal(1.5)}), "", "byte value 1.5 out of range"},
+		{"not a number", cty.TupleVal([]cty.Value{cty.StringVal("a")}), "", "must only contain numbers"},
+		{"null", cty.NullVal(Bytes), "", "value is null"},
+		{"unknown", cty.UnknownVal(cty.String), "", "value is unknown"},
+		{"bool", cty.True, "", "bool value cannot be used as bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AsBytes(tt.v)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %q, want error %q", got, tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBytesFunctions(t *testing.T) {
+	rc := NewContext().NewRequestContext(&RequestData{})
+	rc.EvalContext.Variables["payload"] = BytesVal([]byte(`{"ref":"refs/heads/master"}`))
+	rc.EvalContext.Variables["binary"] = BytesVal([]byte{0xff, 0x00})
+
+	tests := []struct {
+		expr string
+		want string // formatted value
+		err  string // empty if evaluation succeeds
+	}{
+		{`sha256(payload, "secret")`, `"18bd702ca7dab5713101db346ec6cd6768820c090515db9744deff53bc95ff52"`, ""},
+		{`sha256(binary, "secret")`, `"f5414477cbf1995df52083ff7be2191b569fbbda682fd5d01a6852f1345d3254"`, ""},
+		{`eq(sha256(payload, "secret"), "18bd702ca7dab5713101db346ec6cd6768820c090515db9744deff53bc95ff52")`, `true`, ""},
+
+		{`eq(payload, "{\"ref\":\"refs/heads/master\"}")`, `true`, ""},
+		{`eq("{\"ref\":\"refs/heads/master\"}", payload)`, `true`, ""},
+		{`eq(payload, "{}")`, `false`, ""},
+		{`ne(payload, "{}")`, `true`, ""},
+		{`eq(binary, base64decode("/wA="))`, `true`, ""},
+		{`eq(binary, base64decode("/wE="))`, `false`, ""},
+		{`eq(binary, 1)`, `false`, ""},
+
+		{`base64decode("aGk=")`, `(bytes[2])`, ""},
+		{`base64decode("/wA=")`, `(bytes[2])`, ""},
+		{`base64encode(base64decode("/wA="))`, `"/wA="`, ""},
+		{`upper(base64decode("aGk="))`, `"HI"`, ""},
+		{`upper(binary)`, "", "not valid UTF-8"},
+		{`base64decode("!")`, "", "illegal base64 data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, diags := hclsyntax.ParseExpression([]byte(tt.expr), "test.hcl", hcl.InitialPos)
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+
+			v, diags := expr.Value(rc.EvalContext)
+			if tt.err != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("got %s, want error %q", formatValue(v), tt.err)
+				}
+				if !strings.Contains(diags.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", diags.Error(), tt.err)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+			if got := formatValue(v); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// base64decode returns bytes rather than a string.
+	expr, _ := hclsyntax.ParseExpression([]byte(`base64decode("/wA=")`), "test.hcl", hcl.InitialPos)
+	v, diags := expr.Value(rc.EvalContext)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if !v.Type().Equals(Bytes) {
+		t.Errorf("base64decode returned %s, want bytes", v.Type().FriendlyName())
+	}
+	if b, _ := AsBytes(v); string(b) != "\xff\x00" {
+		t.Errorf("base64decode returned %q, want %q", b, "\xff\x00")
+	}
+}
@@ -0,0 +1,367 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// traceFuncs holds the logical functions whose arguments are traced
+// individually by EvalConstraints.  Arguments are evaluated in order, and
+// evaluation stops once an argument equal to the function's short-circuit
+// value is found, since the remaining arguments cannot change the result.
+var traceFuncs = map[string]*bool{
+	"and": boolPtr(false),
+	"all": boolPtr(false),
+	"or":  boolPtr(true),
+	"any": boolPtr(true),
+	"not": nil,
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// Trace records the evaluation of a constraint expression.  Children holds the
+// traces of the arguments of and, or, all, any and not calls.  Skipped is set
+// for arguments that were not evaluated because of short-circuiting.
+type Trace struct {
+	Range    hcl.Range
+	Value    cty.Value
+	Children []*Trace
+	Skipped  bool
+}
+
+// Satisfied reports whether the traced expression evaluated to true.
+func (t *Trace) Satisfied() bool {
+	return t.Value.Type() == cty.Bool && t.Value.IsKnown() && !t.Value.IsNull() && t.Value.True()
+}
+
+// Source returns the text of the traced expression, read from the parsed
+// configuration files.
+func (t *Trace) Source(files map[string]*hcl.File) string {
+	if f, ok := files[t.Range.Filename]; ok && f != nil {
+		if t.Range.End.Byte <= len(f.Bytes) {
+			return string(t.Range.SliceBytes(f.Bytes))
+		}
+	}
+	return t.Range.String()
+}
+
+// Location returns the file and line of the traced expression.
+func (t *Trace) Location() string {
+	return fmt.Sprintf("%s:%d", t.Range.Filename, t.Range.Start.Line)
+}
+
+// Format returns a multi-line description of the trace, with the arguments of
+// logical functions indented below their call.
+func (t *Trace) Format(files map[string]*hcl.File) string {
+	var b strings.Builder
+	t.format(&b, files, 0)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (t *Trace) format(b *strings.Builder, files map[string]*hcl.File, depth int) {
+	fmt.Fprintf(b, "%s%s: %s => %s\n", strings.Repeat("  ", depth), t.Location(), t.Source(files), t.formatValue())
+	for _, c := range t.Children {
+		c.format(b, files, depth+1)
+	}
+}
+
+// RelLocation returns the file and line of the traced expression, with the
+// file relative to dir.
+func (t *Trace) RelLocation(dir string) string {
+	name, err := filepath.Rel(dir, t.Range.Filename)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = filepath.Base(t.Range.Filename)
+	}
+	return fmt.Sprintf("%s:%d", filepath.ToSlash(name), t.Range.Start.Line)
+}
+
+// CtyValue returns the trace as a cty object with location, value and reasons
+// attributes, where reasons holds the traces of any arguments.  The object may
+// be sent to clients, so it omits the source text of the expression, which
+// can hold secrets, and gives the location relative to the configuration
+// directory dir.
+func (t *Trace) CtyValue(dir string) cty.Value {
+	children := make([]cty.Value, len(t.Children))
+	for i, c := range t.Children {
+		children[i] = c.CtyValue(dir)
+	}
+	reasons := cty.EmptyTupleVal
+	if len(children) > 0 {
+		reasons = cty.TupleVal(children)
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"location": cty.StringVal(t.RelLocation(dir)),
+		"value":    cty.StringVal(t.formatValue()),
+		"reasons":  reasons,
+	})
+}
+
+func (t *Trace) formatValue() string {
+	if t.Skipped {
+		return "(skipped)"
+	}
+	return formatValue(t.Value)
+}
+
+// EvalConstraints evaluates each element of a constraints list individually
+// and reports whether all of them are true, along with a trace of each
+// element.  If expr is not a list constructor, it is evaluated as a whole.
+func (rc *RequestContext) EvalConstraints(expr hcl.Expression) (bool, []*Trace, hcl.Diagnostics) {
+	exprs, diags := hcl.ExprList(expr)
+	if diags.HasErrors() {
+		return rc.evalConstraintList(expr)
+	}
+
+	satisfied := true
+	traces := make([]*Trace, 0, len(exprs))
+	for _, e := range exprs {
+		t, diags := rc.traceExpr(e)
+		if diags.HasErrors() {
+			return false, nil, diags
+		}
+		if t.Value, diags = constraintValue(e, t.Value); diags.HasErrors() {
+			return false, nil, diags
+		}
+		if !t.Satisfied() {
+			satisfied = false
+		}
+		traces = append(traces, t)
+	}
+
+	return satisfied, traces, nil
+}
+
+// evalConstraintList evaluates a constraints expression that is not a list
+// constructor, such as a for expression.  The value must be null or a list of
+// bools.
+func (rc *RequestContext) evalConstraintList(expr hcl.Expression) (bool, []*Trace, hcl.Diagnostics) {
+	v, diags := expr.Value(rc.EvalContext)
+	if diags.HasErrors() {
+		return false, nil, diags
+	}
+	if v.IsNull() {
+		return true, nil, nil
+	}
+
+	v, err := convert.Convert(v, cty.List(cty.Bool))
+	if err != nil || !v.IsWhollyKnown() {
+		return false, nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid constraints",
+			Detail:   "The constraints must be a list of bools.",
+			Subject:  expr.Range().Ptr(),
+		}}
+	}
+
+	satisfied := true
+	var traces []*Trace
+	for it := v.ElementIterator(); it.Next(); {
+		_, ev := it.Element()
+		t := &Trace{Range: expr.Range(), Value: ev}
+		if !t.Satisfied() {
+			satisfied = false
+		}
+		traces = append(traces, t)
+	}
+	return satisfied, traces, nil
+}
+
+// traceExpr evaluates e.  The arguments of calls to logical functions are
+// evaluated and traced individually, stopping early if the result is decided,
+// before the function is called with their values.
+func (rc *RequestContext) traceExpr(e hcl.Expression) (*Trace, hcl.Diagnostics) {
+	t := &Trace{Range: e.Range()}
+
+	if p, ok := e.(*hclsyntax.ParenthesesExpr); ok {
+		return rc.traceExpr(p.Expression)
+	}
+
+	call, ok := e.(*hclsyntax.FunctionCallExpr)
+	if !ok || call.ExpandFinal {
+		var diags hcl.Diagnostics
+		t.Value, diags = e.Value(rc.EvalContext)
+		return t, diags
+	}
+	stop, ok := traceFuncs[call.Name]
+	if !ok {
+		var diags hcl.Diagnostics
+		t.Value, diags = e.Value(rc.EvalContext)
+		return t, diags
+	}
+
+	f, ok := lookupFunction(rc.EvalContext, call.Name)
+	if !ok {
+		var diags hcl.Diagnostics
+		t.Value, diags = e.Value(rc.EvalContext)
+		return t, diags
+	}
+	if stop != nil && validArity(f, len(call.Args)) {
+		for i, arg := range call.Args {
+			ct, diags := rc.traceExpr(arg)
+			if diags.HasErrors() {
+				return t, diags
+			}
+			t.Children = append(t.Children, ct)
+
+			bv, err := convert.Convert(ct.Value, cty.Bool)
+			if err != nil || bv.IsNull() || !bv.IsKnown() || bv.True() != *stop {
+				continue
+			}
+
+			for _, skipped := range call.Args[i+1:] {
+				t.Children = append(t.Children, &Trace{Range: skipped.Range(), Skipped: true})
+			}
+			if i+1 < len(call.Args) {
+				rc.debugf("%s(...) => %t (remaining arguments skipped)", call.Name, *stop)
+			}
+			break
+		}
+
+		if n := len(t.Children); n > 0 && t.Children[n-1].Skipped {
+			t.Value = cty.BoolVal(*stop)
+			return t, nil
+		}
+	} else {
+		for _, arg := range call.Args {
+			ct, diags := rc.traceExpr(arg)
+			if diags.HasErrors() {
+				return t, diags
+			}
+			t.Children = append(t.Children, ct)
+		}
+	}
+
+	// Convert the arguments to the parameter types, as hclsyntax does.
+	params := f.Params()
+	args := make([]cty.Value, len(t.Children))
+	for i, ct := range t.Children {
+		args[i] = ct.Value
+
+		p := f.VarParam()
+		if i < len(params) {
+			p = &params[i]
+		}
+		if p == nil {
+			continue // reported by the call
+		}
+		v, err := convert.Convert(ct.Value, p.Type)
+		if err != nil {
+			return t, hcl.Diagnostics{{
+				Severity:    hcl.DiagError,
+				Summary:     "Invalid function argument",
+				Detail:      fmt.Sprintf("Invalid value for %q parameter: %s.", p.Name, err),
+				Subject:     call.Args[i].Range().Ptr(),
+				Expression:  call,
+				EvalContext: rc.EvalContext,
+			}}
+		}
+		args[i] = v
+	}
+
+	v, err := f.Call(args)
+	if err != nil {
+		return t, hcl.Diagnostics{{
+			Severity:    hcl.DiagError,
+			Summary:     "Error in function call",
+			Detail:      fmt.Sprintf("Call to function %q failed: %s.", call.Name, err),
+			Subject:     call.Range().Ptr(),
+			Expression:  call,
+			EvalContext: rc.EvalContext,
+		}}
+	}
+	t.Value = v
+
+	return t, nil
+}
+
+// CheckLogicalCalls warns of the calls to and, or, all and any in the hook that
+// are not short-circuited.  Only the calls traced by EvalConstraints are: the
+// elements of a constraints list and the arguments of logical calls that are
+// traced.  Elsewhere, such as in eq(or(...), true), a conditional, the task
+// or a response, all of their arguments are evaluated.
+func (h *Hook) CheckLogicalCalls() hcl.Diagnostics {
+	body, ok := h.PreExecConfig.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+
+	traced := make(map[*hclsyntax.FunctionCallExpr]bool)
+	if attr, ok := body.Attributes["constraints"]; ok {
+		if exprs, diags := hcl.ExprList(attr.Expr); !diags.HasErrors() {
+			for _, e := range exprs {
+				markTraced(e, traced)
+			}
+		}
+	}
+
+	var diags hcl.Diagnostics
+	hclsyntax.VisitAll(body, func(n hclsyntax.Node) hcl.Diagnostics {
+		call, ok := n.(*hclsyntax.FunctionCallExpr)
+		if !ok || traceFuncs[call.Name] == nil || traced[call] {
+			return nil
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Logical function is not short-circuited",
+			Detail:   fmt.Sprintf("All arguments of %s() are evaluated here. Only constraints, and the arguments of logical functions within them, stop evaluating once the result is decided.", call.Name),
+			Subject:  call.Range().Ptr(),
+		})
+		return nil
+	})
+	return diags
+}
+
+// markTraced records the logical calls in e that traceExpr traces.
+func markTraced(e hcl.Expression, traced map[*hclsyntax.FunctionCallExpr]bool) {
+	if p, ok := e.(*hclsyntax.ParenthesesExpr); ok {
+		markTraced(p.Expression, traced)
+		return
+	}
+
+	call, ok := e.(*hclsyntax.FunctionCallExpr)
+	if !ok || call.ExpandFinal {
+		return
+	}
+	if _, ok := traceFuncs[call.Name]; !ok {
+		return
+	}
+	traced[call] = true
+	for _, arg := range call.Args {
+		markTraced(arg, traced)
+	}
+}
+
+// validArity reports whether f accepts n arguments.  Calls with the wrong
+// number of arguments are not short-circuited, so that the error is reported
+// by the function.
+func validArity(f function.Function, n int) bool {
+	params := len(f.Params())
+	if f.VarParam() == nil {
+		return n == params
+	}
+	return n >= params && n > 0
+}
+
+// constraintValue converts the value of a constraint to a known bool.
+func constraintValue(e hcl.Expression, v cty.Value) (cty.Value, hcl.Diagnostics) {
+	bv, err := convert.Convert(v, cty.Bool)
+	if err != nil || bv.IsNull() || !bv.IsKnown() {
+		return v, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid constraint",
+			Detail:   "Each constraint must evaluate to a bool.",
+			Subject:  e.Range().Ptr(),
+		}}
+	}
+	return bv, nil
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// parseTestConfig parses src as the body of a hook in test.hcl.
+func parseTestConfig(t *testing.T, src string) (*hcl.File, *hclsyntax.Body) {
+	t.Helper()
+	f, diags := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	return f, f.Body.(*hclsyntax.Body)
+}
+
+// testRequestContext returns a request context with testPayload as the
+// payload.
+func testRequestContext(t *testing.T) *RequestContext {
+	t.Helper()
+	payload, err := ParseJSONPayload([]byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewContext().NewRequestContext(&RequestData{
+		Payload: payload,
+		Headers: map[string]string{"x-event": "push"},
+	})
+}
+
+// traceString describes the values of a trace and its children, such as
+// true(true, (skipped)).
+func traceString(t *Trace) string {
+	s := t.formatValue()
+	if len(t.Children) > 0 {
+		children := make([]string, len(t.Children))
+		for i, c := range t.Children {
+			children[i] = traceString(c)
+		}
+		s += "(" + strings.Join(children, ", ") + ")"
+	}
+	return s
+}
+
+func TestEvalConstraints(t *testing.T) {
+	tests := []struct {
+		constraints string
+		satisfied   bool
+		traces      []string
+		err         string // empty if evaluation succeeds
+	}{
+		// Evaluation stops at the first decisive argument, so the
+		// missing payload value is never looked up.
+		{`[or(true, payload("missing") == 1)]`, true, []string{`true(true, (skipped))`}, ""},
+		{`[any(false, true, payload("missing"))]`, true, []string{`true(false, true, (skipped))`}, ""},
+		{`[and(false, payload("missing") == 1)]`, false, []string{`false(false, (skipped))`}, ""},
+		{`[all(true, false, payload("missing"))]`, false, []string{`false(true, false, (skipped))`}, ""},
+		{`[or(false, payload("missing") == 1)]`, false, nil, `failed to find payload value "missing"`},
+		{`[and(true, payload("missing") == 1)]`, false, nil, `failed to find payload value "missing"`},
+
+		// Nested and parenthesized calls.
+		{`[and(true, or(false, payload("ref") == "refs/heads/master"))]`, true,
+			[]string{`true(true, true(false, true))`}, ""},
+		{`[not(and(false, payload("missing")))]`, true, []string{`true(false(false, (skipped)))`}, ""},
+		{`[(or(true, payload("missing")))]`, true, []string{`true(true, (skipped))`}, ""},
+		{`[or(and(false, payload("missing")), header("X-Event") == "push")]`, true,
+			[]string{`true(false(false, (skipped)), true)`}, ""},
+
+		// Each element is traced separately.
+		{`[true, or(false, false), eq(payload("commits.0.id"), "a1")]`, false,
+			[]string{`true`, `false(false, false)`, `true`}, ""},
+
+		// Non-bool arguments are converted by the function.
+		{`[and("true", 1 == 1)]`, true, []string{`true("true", true)`}, ""},
+		{`[or("false", "true")]`, true, []string{`true("false", "true")`}, ""},
+		{`[and(1, true)]`, false, nil, `Invalid value for "a" parameter`},
+		{`["true"]`, true, []string{`true`}, ""},
+		{`["yes"]`, false, nil, "Each constraint must evaluate to a bool"},
+
+		// Short-circuiting is limited to constraints and the logical
+		// calls within them.
+		{`[eq(or(true, payload("missing")), true)]`, false, nil, `failed to find payload value "missing"`},
+		{`[[and(false, payload("missing"))][0]]`, false, nil, `failed to find payload value "missing"`},
+
+		// Constraints that are not a list constructor are evaluated as a
+		// whole.
+		{`[for c in ["a1", "b2"] : c == payload("commits.0.id")]`, false, []string{`true`, `false`}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraints, func(t *testing.T) {
+			_, body := parseTestConfig(t, "constraints = "+tt.constraints+"\n")
+			rc := testRequestContext(t)
+
+			satisfied, traces, diags := rc.EvalConstraints(body.Attributes["constraints"].Expr)
+			if tt.err != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no error, want %q", tt.err)
+				}
+				if !strings.Contains(diags.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", diags.Error(), tt.err)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+
+			if satisfied != tt.satisfied {
+				t.Errorf("satisfied = %t, want %t", satisfied, tt.satisfied)
+			}
+			got := make([]string, len(traces))
+			for i, tr := range traces {
+				got[i] = traceString(tr)
+			}
+			if strings.Join(got, "; ") != strings.Join(tt.traces, "; ") {
+				t.Errorf("traces = %q, want %q", got, tt.traces)
+			}
+		})
+	}
+}
+
+func TestCheckLogicalCalls(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string // line and function of each warning
+	}{
+		{"constraints", `
+constraints = [
+  or(true, and(false, any(true))),
+  (all(true)),
+  not(or(true)),
+]`, nil},
+		{"under other expressions", `
+constraints = [
+  eq(or(true, false), true),
+  true ? and(true, true) : false,
+  [any(true)][0],
+]`, []string{"3:or", "4:and", "5:any"}},
+		{"outside constraints", `
+debounce {
+  key = any(true) ? "a" : "b"
+}
+task {
+  cmd = ["echo", "${or(true, false)}"]
+}
+response {
+  success {
+    body = all(true) ? "ok" : "no"
+  }
+}`, []string{"3:any", "6:or", "10:all"}},
+		{"constraints not a list", `
+constraints = [for b in [true] : and(b, true)]
+`, []string{"2:and"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, body := parseTestConfig(t, tt.src)
+			h := &Hook{ID: "test", PreExecConfig: body}
+
+			var got []string
+			for _, d := range h.CheckLogicalCalls() {
+				if d.Severity != hcl.DiagWarning {
+					t.Errorf("severity %v, want a warning", d.Severity)
+				}
+				name := strings.TrimPrefix(d.Detail, "All arguments of ")
+				name = name[:strings.Index(name, "()")]
+				got = append(got, fmt.Sprintf("%d:%s", d.Subject.Start.Line, name))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("warnings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceReasons(t *testing.T) {
+	src := `constraints = [
+  eq(payload("ref"), "refs/heads/master"),
+  or(eq(header("X-Event"), "tag"), not(true)),
+  and(false, header("X-Token") == "secret"),
+]
+`
+	f, diags := hclsyntax.ParseConfig([]byte(src), "/etc/webhook/conf.d/test.hcl", hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	files := map[string]*hcl.File{"/etc/webhook/conf.d/test.hcl": f}
+	expr := f.Body.(*hclsyntax.Body).Attributes["constraints"].Expr
+
+	satisfied, traces, diags := testRequestContext(t).EvalConstraints(expr)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if satisfied {
+		t.Fatal("constraints satisfied, want unsatisfied")
+	}
+
+	var got []bool
+	for _, tr := range traces {
+		got = append(got, tr.Satisfied())
+	}
+	if fmt.Sprint(got) != "[true false false]" {
+		t.Errorf("satisfied = %v, want [true false false]", got)
+	}
+
+	const loc = "/etc/webhook/conf.d/test.hcl:3"
+	wantFormat := loc + `: or(eq(header("X-Event"), "tag"), not(true)) => false
+  ` + loc + `: eq(header("X-Event"), "tag") => false
+  ` + loc + `: not(true) => false
+    ` + loc + `: true => true`
+	if got := traces[1].Format(files); got != wantFormat {
+		t.Errorf("Format:\n%s\nwant:\n%s", got, wantFormat)
+	}
+
+	// Without the file, the source is replaced by the range.
+	if got, want := traces[0].Format(nil), "/etc/webhook/conf.d/test.hcl:2: /etc/webhook/conf.d/test.hcl:2,3-42 => true"; got != want {
+		t.Errorf("Format without files = %q, want %q", got, want)
+	}
+
+	// The reasons sent to clients give locations relative to the
+	// configuration directory and omit the source.
+	tests := []struct {
+		trace *Trace
+		dir   string
+		want  string
+	}{
+		{traces[0], "/etc/webhook", `{"location":"conf.d/test.hcl:2","reasons":[],"value":"true"}`},
+		{traces[1], "/etc/webhook/conf.d", `{"location":"test.hcl:3","reasons":[` +
+			`{"location":"test.hcl:3","reasons":[],"value":"false"},` +
+			`{"location":"test.hcl:3","reasons":[{"location":"test.hcl:3","reasons":[],"value":"true"}],"value":"false"}` +
+			`],"value":"false"}`},
+		{traces[2], "/srv/other", `{"location":"test.hcl:4","reasons":[` +
+			`{"location":"test.hcl:4","reasons":[],"value":"false"},` +
+			`{"location":"test.hcl:4","reasons":[],"value":"(skipped)"}` +
+			`],"value":"false"}`},
+	}
+	for _, tt := range tests {
+		got := formatValue(tt.trace.CtyValue(tt.dir))
+		if got != tt.want {
+			t.Errorf("CtyValue(%q) = %s, want %s", tt.dir, got, tt.want)
+		}
+		if strings.Contains(got, "secret") || strings.Contains(got, "X-Event") {
+			t.Errorf("CtyValue(%q) exposes the source: %s", tt.dir, got)
+		}
+	}
+}
@@ -24,13 +24,14 @@ import (
 	"github.com/zclconf/go-cty/cty/function/stdlib"
 )
 
+// Context holds the functions of the expression language that do not depend
+// on an incoming request.  A Context is built once and shared by every
+// request; request data is bound by NewRequestContext.
 type Context struct {
 	EvalContext *hcl.EvalContext
 
-	Payload map[string]interface{}
-	Headers map[string]string
-	Params  map[string]string
-
+	// Debug enables debug logging of function calls.  It must not be
+	// changed once the Context is in use.
 	Debug bool
 }
 
@@ -42,11 +43,8 @@ func NewContext() *Context {
 	}
 
 	c.EvalContext.Functions = map[string]function.Function{
-		"join": stdlib.JoinFunc,
-
-		"header":  c.HeaderFunc(),
-		"payload": c.PayloadFunc(),
-		"url":     c.URLFunc(),
+		"join":       stdlib.JoinFunc,
+		"jsonencode": stdlib.JSONEncodeFunc,
 
 		"all":          c.allFunc(),
 		"and":          c.andFunc(),
@@ -90,8 +88,62 @@ func (c *Context) debugf(format string, v ...interface{}) {
 	}
 }
 
-func (c *Context) PayloadFunc() function.Function {
-	// TODO: rewrite to use stdlib.HasIndex() or something
+// RequestData holds the data of an incoming request used by the
+// request-bound functions.  It must not be modified once bound to a
+// RequestContext.
+type RequestData struct {
+	Payload cty.Value
+	Headers map[string]string
+	Params  map[string]string
+	Path    map[string]string
+}
+
+// RequestContext is the evaluation context of a single request.  Its
+// EvalContext is a child of the shared Context's, adding the header, path,
+// payload and url functions bound to the request along with the request's
+// variables.  A RequestContext must only be used by one goroutine at a time,
+// but any number may share the same Context.
+type RequestContext struct {
+	EvalContext *hcl.EvalContext
+	Request     *RequestData
+
+	ctx *Context
+}
+
+// NewRequestContext returns an evaluation context for the given request.
+func (c *Context) NewRequestContext(req *RequestData) *RequestContext {
+	rc := &RequestContext{
+		EvalContext: c.EvalContext.NewChild(),
+		Request:     req,
+		ctx:         c,
+	}
+
+	rc.EvalContext.Variables = map[string]cty.Value{}
+	rc.EvalContext.Functions = map[string]function.Function{
+		"header":  rc.HeaderFunc(),
+		"path":    rc.PathFunc(),
+		"payload": rc.PayloadFunc(),
+		"url":     rc.URLFunc(),
+	}
+
+	return rc
+}
+
+func (rc *RequestContext) debugf(format string, v ...interface{}) {
+	rc.ctx.debugf(format, v...)
+}
+
+// lookupFunction returns the named function from ctx or its ancestors.
+func lookupFunction(ctx *hcl.EvalContext, name string) (function.Function, bool) {
+	for ; ctx != nil; ctx = ctx.Parent() {
+		if f, ok := ctx.Functions[name]; ok {
+			return f, true
+		}
+	}
+	return function.Function{}, false
+}
+
+func (rc *RequestContext) PayloadFunc() function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
 			{
@@ -102,19 +154,18 @@ func (c *Context) PayloadFunc() function.Function {
 		Type: function.StaticReturnType(cty.DynamicPseudoType),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
 			k := args[0].AsString()
-			kk := strings.ToLower(k)
-			if v, ok := c.Payload[kk]; ok {
-				s := fmt.Sprintf("%v", v)
-				c.debugf("payload(%q) => [%T] %q", k, v, s)
-				return cty.StringVal(s), nil
+			v, err := LookupPayload(rc.Request.Payload, k)
+			if err != nil {
+				// TODO: should we return an error here?
+				return cty.StringVal(""), err
 			}
-			// TODO: should we return an error here?
-			return cty.StringVal(""), fmt.Errorf("failed to find payload value: %s", k)
+			rc.debugf("payload(%q) => [%s] %s", k, v.Type().FriendlyName(), formatValue(v))
+			return v, nil
 		},
 	})
 }
 
-func (c *Context) HeaderFunc() function.Function {
+func (rc *RequestContext) HeaderFunc() function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
 			{
@@ -126,18 +177,18 @@ func (c *Context) HeaderFunc() function.Function {
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
 			k := args[0].AsString()
 			kk := strings.ToLower(k)
-			if v, ok := c.Headers[kk]; ok {
+			if v, ok := rc.Request.Headers[kk]; ok {
 				s := fmt.Sprintf("%v", v)
-				c.debugf("header(%q) => %q", k, s)
+				rc.debugf("header(%q) => %q", k, s)
 				return cty.StringVal(v), nil
 			}
-			c.debugf("header(%q) => %q", k, "")
+			rc.debugf("header(%q) => %q", k, "")
 			return cty.StringVal(""), nil
 		},
 	})
 }
 
-func (c *Context) URLFunc() function.Function {
+func (rc *RequestContext) URLFunc() function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
 			{
@@ -149,23 +200,43 @@ func (c *Context) URLFunc() function.Function {
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
 			k := args[0].AsString()
 			kk := strings.ToLower(k)
-			if v, ok := c.Params[kk]; ok {
+			if v, ok := rc.Request.Params[kk]; ok {
 				s := fmt.Sprintf("%v", v)
-				c.debugf("url(%q) => %q", k, s)
+				rc.debugf("url(%q) => %q", k, s)
 				return cty.StringVal(v), nil
 			}
-			c.debugf("url(%q) => %q", k, "")
+			rc.debugf("url(%q) => %q", k, "")
 			return cty.StringVal(""), nil
 		},
 	})
 }
 
+func (rc *RequestContext) PathFunc() function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{
+				Name: "name",
+				Type: cty.String,
+			},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			k := args[0].AsString()
+			if v, ok := rc.Request.Path[k]; ok {
+				rc.debugf("path(%q) => %q", k, v)
+				return cty.StringVal(v), nil
+			}
+			return cty.StringVal(""), fmt.Errorf("no such path variable: %s", k)
+		},
+	})
+}
+
 func (c *Context) sha1Func() function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
 			{
 				Name: "data",
-				Type: cty.String,
+				Type: cty.DynamicPseudoType,
 			},
 			{
 				Name: "secret",
@@ -174,18 +245,21 @@ func (c *Context) sha1Func() function.Function {
 		},
 		Type: function.StaticReturnType(cty.String),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-			data := args[0].AsString()
+			data, err := AsBytes(args[0])
+			if err != nil {
+				return cty.StringVal(""), err
+			}
 			secret := args[1].AsString()
 
 			mac := hmac.New(sha1.New, []byte(secret))
-			_, err := mac.Write([]byte(data))
+			_, err = mac.Write(data)
 			if err != nil {
 				return cty.StringVal(""), err
 			}
 
 			expectedMAC := hex.EncodeToString(mac.Sum(nil))
 
-			c.debugf("sha1(%q, %q) => %q", data, secret, expectedMAC)
+			c.debugf("sha1(%s, %q) => %q", formatValue(args[0]), secret, expectedMAC)
 			return cty.StringVal(expectedMAC), err
 		},
 	})
@@ -196,7 +270,7 @@ func (c *Context) sha256Func() function.Function {
 		Params: []function.Parameter{
 			{
 				Name: "data",
-				Type: cty.String,
+				Type: cty.DynamicPseudoType,
 			},
 			{
 				Name: "secret",
@@ -205,18 +279,21 @@ func (c *Context) sha256Func() function.Function {
 		},
 		Type: function.StaticReturnType(cty.String),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-			data := args[0].AsString()
+			data, err := AsBytes(args[0])
+			if err != nil {
+				return cty.StringVal(""), err
+			}
 			secret := args[1].AsString()
 
 			mac := hmac.New(sha256.New, []byte(secret))
-			_, err := mac.Write([]byte(data))
+			_, err = mac.Write(data)
 			if err != nil {
 				return cty.StringVal(""), err
 			}
 
 			expectedMAC := hex.EncodeToString(mac.Sum(nil))
 
-			c.debugf("sha256(%q, %q) => %q", data, secret, expectedMAC)
+			c.debugf("sha256(%s, %q) => %q", formatValue(args[0]), secret, expectedMAC)
 			return cty.StringVal(expectedMAC), err
 		},
 	})
@@ -227,7 +304,7 @@ func (c *Context) sha512Func() function.Function {
 		Params: []function.Parameter{
 			{
 				Name: "data",
-				Type: cty.String,
+				Type: cty.DynamicPseudoType,
 			},
 			{
 				Name: "secret",
@@ -236,18 +313,21 @@ func (c *Context) sha512Func() function.Function {
 		},
 		Type: function.StaticReturnType(cty.String),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-			data := args[0].AsString()
+			data, err := AsBytes(args[0])
+			if err != nil {
+				return cty.StringVal(""), err
+			}
 			secret := args[1].AsString()
 
 			mac := hmac.New(sha512.New, []byte(secret))
-			_, err := mac.Write([]byte(data))
+			_, err = mac.Write(data)
 			if err != nil {
 				return cty.StringVal(""), err
 			}
 
 			expectedMAC := hex.EncodeToString(mac.Sum(nil))
 
-			c.debugf("sha512(%q, %q) => %q", data, secret, expectedMAC)
+			c.debugf("sha512(%s, %q) => %q", formatValue(args[0]), secret, expectedMAC)
 			return cty.StringVal(expectedMAC), err
 		},
 	})
@@ -435,7 +515,6 @@ func (c *Context) anyFunc() function.Function {
 	})
 }
 
-// TODO: String vs Bytes
 func (c *Context) base64decodeFunc() function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
@@ -444,20 +523,18 @@ func (c *Context) base64decodeFunc() function.Function {
 				Type: cty.String,
 			},
 		},
-		// Type: function.StaticReturnType(stdlib.Bytes),
-		Type: function.StaticReturnType(cty.String),
+		Type: function.StaticReturnType(Bytes),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
 			s := args[0].AsString()
 
 			data, err := base64.StdEncoding.DecodeString(s)
 			if err != nil {
-				return stdlib.BytesVal([]byte{}), err
+				return BytesVal(nil), err
 			}
 
-			ret := string(data)
-			c.debugf("base64decode(%q) => %q", s, ret)
-			return cty.StringVal(ret), nil
-			// return stdlib.BytesVal(data), err
+			ret := BytesVal(data)
+			c.debugf("base64decode(%q) => %s", s, formatValue(ret))
+			return ret, nil
 		},
 	})
 }
@@ -467,14 +544,17 @@ func (c *Context) base64encodeFunc() function.Function {
 		Params: []function.Parameter{
 			{
 				Name: "s",
-				Type: cty.String,
+				Type: cty.DynamicPseudoType,
 			},
 		},
 		Type: function.StaticReturnType(cty.String),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-			s := args[0].AsString()
-			data := base64.StdEncoding.EncodeToString([]byte(s))
-			c.debugf("base64encode(%q) => %q", s, string(data))
+			b, err := AsBytes(args[0])
+			if err != nil {
+				return cty.StringVal(""), err
+			}
+			data := base64.StdEncoding.EncodeToString(b)
+			c.debugf("base64encode(%s) => %q", formatValue(args[0]), data)
 			return cty.StringVal(data), nil
 		},
 	})
@@ -555,17 +635,18 @@ func (c *Context) readfileFunc() function.Function {
 				Type: cty.String,
 			},
 		},
-		Type: function.StaticReturnType(cty.String),
+		Type: function.StaticReturnType(Bytes),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
 			path := args[0].AsString()
 
 			b, err := os.ReadFile(path)
 			if err != nil {
-				return cty.BoolVal(false), err
+				return BytesVal(nil), err
 			}
 
-			c.debugf("readfile(%q) => %q", path, string(b))
-			return cty.StringVal(string(b)), nil
+			ret := BytesVal(b)
+			c.debugf("readfile(%q) => %s", path, formatValue(ret))
+			return ret, nil
 		},
 	})
 }
@@ -591,13 +672,9 @@ func (c *Context) eqFunc() function.Function {
 		Type: function.StaticReturnType(cty.Bool),
 		Impl: func(args []cty.Value, retType cty.Type) (ret cty.Value, err error) {
 			// security: use constant time compare on strings
-			if (args[0].Type() == cty.String || args[0].Type() == stdlib.Bytes) &&
-				(args[1].Type() == cty.String || args[1].Type() == stdlib.Bytes) {
-
-				a := args[0].AsString()
-				b := args[1].AsString()
-				result := subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
-				c.debugf("eq(%q, %q) => %v\n", a, b, result)
+			if a, b, ok := stringsOrBytes(args[0], args[1]); ok {
+				result := subtle.ConstantTimeCompare(a, b) == 1
+				c.debugf("eq(%s, %s) => %v\n", formatValue(args[0]), formatValue(args[1]), result)
 				return cty.BoolVal(result), nil
 			}
 
@@ -820,10 +897,9 @@ func (c *Context) formatFunc() function.Function {
 				return ret, err
 			}
 
-			// TODO: how to make this work with any data types?
 			vargs := make([]string, len(args[1:]))
 			for i, v := range args[1:] {
-				vargs[i] = `"` + v.AsString() + `"`
+				vargs[i] = formatValue(v)
 			}
 			c.debugf("format(%q, %s) => %q", args[0].AsString(), strings.Join(vargs, ", "), ret.AsString())
 			return ret, err
@@ -951,6 +1027,12 @@ func (c *Context) neFunc() function.Function {
 		},
 		Type: function.StaticReturnType(cty.Bool),
 		Impl: func(args []cty.Value, retType cty.Type) (ret cty.Value, err error) {
+			if a, b, ok := stringsOrBytes(args[0], args[1]); ok {
+				result := subtle.ConstantTimeCompare(a, b) != 1
+				c.debugf("ne(%s, %s) => %v", formatValue(args[0]), formatValue(args[1]), result)
+				return cty.BoolVal(result), nil
+			}
+
 			ret = args[0].Equals(args[1]).Not()
 			// TODO: print params?
 			c.debugf("ne(...) => %t", ret.True())
@@ -958,3 +1040,17 @@ func (c *Context) neFunc() function.Function {
 		},
 	})
 }
+
+// stringsOrBytes returns the raw data of a and b if both are known, non-null
+// strings or Bytes values, so that strings and bytes compare by content.
+func stringsOrBytes(a, b cty.Value) ([]byte, []byte, bool) {
+	for _, v := range []cty.Value{a, b} {
+		if v.IsNull() || !v.IsKnown() || !(v.Type() == cty.String || v.Type().Equals(Bytes)) {
+			return nil, nil, false
+		}
+	}
+
+	ab, _ := AsBytes(a)
+	bb, _ := AsBytes(b)
+	return ab, bb, true
+}
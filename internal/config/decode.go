@@ -0,0 +1,246 @@
+package config
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// maxMultipartMemory is the number of bytes of a multipart body held in memory
+// before file parts are spooled to disk.
+const maxMultipartMemory = 32 << 20
+
+// ParsePayload decodes a request body into a cty value according to the given
+// Content-Type.  JSON, URL-encoded forms, multipart forms, XML and plain text
+// bodies are supported.  Bodies of any other type, as well as empty bodies,
+// decode to an empty object.
+//
+// If contentType is empty, the body is decoded as JSON if it looks like a JSON
+// object or array and as plain text otherwise.
+func ParsePayload(contentType string, body []byte) (cty.Value, error) {
+	if len(body) == 0 {
+		return cty.EmptyObjectVal, nil
+	}
+
+	if contentType == "" {
+		trimmed := bytes.TrimSpace(body)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return ParseJSONPayload(body)
+		}
+		return cty.StringVal(string(body)), nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("error parsing content type %q: %s", contentType, err)
+	}
+
+	switch {
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return ParseJSONPayload(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		return parseFormPayload(body)
+	case mediaType == "multipart/form-data":
+		return parseMultipartPayload(body, params["boundary"])
+	case mediaType == "application/xml", mediaType == "text/xml", strings.HasSuffix(mediaType, "+xml"):
+		return parseXMLPayload(body)
+	case strings.HasPrefix(mediaType, "text/"):
+		return cty.StringVal(string(body)), nil
+	default:
+		return cty.EmptyObjectVal, nil
+	}
+}
+
+// ParseJSONPayload decodes a JSON document into a cty value, preserving the
+// structure and types of the document.
+func ParseJSONPayload(b []byte) (cty.Value, error) {
+	ty, err := ctyjson.ImpliedType(b)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("error parsing JSON payload: %s", err)
+	}
+
+	v, err := ctyjson.Unmarshal(b, ty)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("error parsing JSON payload: %s", err)
+	}
+
+	return v, nil
+}
+
+// parseFormPayload decodes a URL-encoded form.  Fields with a single value
+// decode to a string and repeated fields decode to a tuple of strings.
+func parseFormPayload(body []byte) (cty.Value, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("error parsing form payload: %s", err)
+	}
+
+	return formValue(values, nil), nil
+}
+
+// parseMultipartPayload decodes a multipart form.  Value fields decode as in
+// parseFormPayload.  File fields decode to an object with filename,
+// content_type, size and content attributes, or a tuple of such objects if
+// the field is repeated.
+func parseMultipartPayload(body []byte, boundary string) (cty.Value, error) {
+	if boundary == "" {
+		return cty.NilVal, fmt.Errorf("error parsing multipart payload: missing boundary")
+	}
+
+	form, err := multipart.NewReader(bytes.NewReader(body), boundary).ReadForm(maxMultipartMemory)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("error parsing multipart payload: %s", err)
+	}
+	defer form.RemoveAll()
+
+	files := make(map[string][]cty.Value, len(form.File))
+	for name, headers := range form.File {
+		for _, fh := range headers {
+			v, err := fileValue(fh)
+			if err != nil {
+				return cty.NilVal, fmt.Errorf("error parsing multipart payload: %s", err)
+			}
+			files[name] = append(files[name], v)
+		}
+	}
+
+	return formValue(form.Value, files), nil
+}
+
+func fileValue(fh *multipart.FileHeader) (cty.Value, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return cty.NilVal, err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return cty.NilVal, err
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"filename":     cty.StringVal(fh.Filename),
+		"content_type": cty.StringVal(fh.Header.Get("Content-Type")),
+		"size":         cty.NumberIntVal(fh.Size),
+		"content":      BytesVal(b),
+	}), nil
+}
+
+// formValue merges form values and files into a single object.
+func formValue(values map[string][]string, files map[string][]cty.Value) cty.Value {
+	if len(values) == 0 && len(files) == 0 {
+		return cty.EmptyObjectVal
+	}
+
+	m := make(map[string]cty.Value, len(values)+len(files))
+	for k, vs := range values {
+		elems := make([]cty.Value, len(vs))
+		for i, v := range vs {
+			elems[i] = cty.StringVal(v)
+		}
+		m[k] = singleOrTuple(elems)
+	}
+	for k, vs := range files {
+		m[k] = singleOrTuple(vs)
+	}
+
+	return cty.ObjectVal(m)
+}
+
+func singleOrTuple(vs []cty.Value) cty.Value {
+	if len(vs) == 1 {
+		return vs[0]
+	}
+	return cty.TupleVal(vs)
+}
+
+// xmlNode is an element read by parseXMLPayload.
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     strings.Builder
+}
+
+// parseXMLPayload decodes an XML document into an object keyed by the name of
+// the root element.  Elements with neither attributes nor child elements
+// decode to their text content.  Other elements decode to objects in which
+// attributes are prefixed with "-", child elements are keyed by name (as a
+// tuple if repeated), and any text content is stored under "#text".
+func parseXMLPayload(body []byte) (cty.Value, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+
+	var root *xmlNode
+	var stack []*xmlNode
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cty.NilVal, fmt.Errorf("error parsing XML payload: %s", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return cty.NilVal, fmt.Errorf("error parsing XML payload: no root element")
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		root.name: root.value(),
+	}), nil
+}
+
+func (n *xmlNode) value() cty.Value {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return cty.StringVal(text)
+	}
+
+	m := make(map[string]cty.Value)
+	for _, a := range n.attrs {
+		m["-"+a.Name.Local] = cty.StringVal(a.Value)
+	}
+
+	grouped := make(map[string][]cty.Value)
+	for _, c := range n.children {
+		grouped[c.name] = append(grouped[c.name], c.value())
+	}
+	for name, vs := range grouped {
+		m[name] = singleOrTuple(vs)
+	}
+
+	if text != "" {
+		m["#text"] = cty.StringVal(text)
+	}
+
+	return cty.ObjectVal(m)
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMultipart = "--XYZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+	"release\r\n" +
+	"--XYZ\r\n" +
+	"Content-Disposition: form-data; name=\"binary\"; filename=\"app.bin\"\r\n" +
+	"Content-Type: application/octet-stream\r\n\r\n" +
+	"\x00\x01\x02\r\n" +
+	"--XYZ--\r\n"
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string // formatted value
+		err         string // empty if parsing succeeds
+	}{
+		{"empty body", "application/json", "", `{}`, ""},
+
+		{"json", "application/json", `{"a":[1,"b"],"c":{"d":null}}`, `{"a":[1,"b"],"c":{"d":null}}`, ""},
+		{"json with charset", "application/json; charset=utf-8", `{"a":true}`, `{"a":true}`, ""},
+		{"json suffix", "application/vnd.github+json", `["x"]`, `["x"]`, ""},
+		{"invalid json", "application/json", `{"a":`, "", "error parsing JSON payload"},
+
+		{"form", "application/x-www-form-urlencoded", "a=1&b=x%20y&a=2", `{"a":["1","2"],"b":"x y"}`, ""},
+		{"invalid form", "application/x-www-form-urlencoded", "a=%zz", "", "error parsing form payload"},
+
+		{"multipart", "multipart/form-data; boundary=XYZ", testMultipart,
+			`{"binary":{"content":"AAEC","content_type":"application/octet-stream","filename":"app.bin","size":3},"title":"release"}`, ""},
+		{"multipart without boundary", "multipart/form-data", testMultipart, "", "missing boundary"},
+
+		{"xml", "application/xml", `<push ref="master"><commit>a1</commit><commit>b2</commit>note</push>`,
+			`{"push":{"#text":"note","-ref":"master","commit":["a1","b2"]}}`, ""},
+		{"text xml", "text/xml", `<a>b</a>`, `{"a":"b"}`, ""},
+		{"xml suffix", "application/atom+xml", `<feed/>`, `{"feed":""}`, ""},
+		{"invalid xml", "application/xml", `<a>`, "", "error parsing XML payload"},
+		{"xml without root", "application/xml", `<!-- none -->`, "", "no root element"},
+
+		{"text", "text/plain", "hello", `"hello"`, ""},
+		{"unknown type", "application/octet-stream", "\x00\x01", `{}`, ""},
+		{"invalid type", "application/json; =", `{}`, "", "error parsing content type"},
+
+		{"sniffed object", "", ` {"a":1}`, `{"a":1}`, ""},
+		{"sniffed array", "", `[1]`, `[1]`, ""},
+		{"sniffed text", "", "a=1", `"a=1"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := ParsePayload(tt.contentType, []byte(tt.body))
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %s, want error %q", formatValue(v), tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatValue(v); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
 )
 
 type Service struct {
@@ -18,6 +20,29 @@ type Service struct {
 	NoPanic     *bool     `hcl:"nopanic"`
 	PIDFile     *string   `hcl:"pidfile"`
 	HTTPMethods *[]string `hcl:"http_methods"`
+	HotReload   *bool     `hcl:"hotreload"`
+
+	AsyncWorkers *int `hcl:"async_workers"`
+	JobHistory   *int `hcl:"job_history"`
+
+	// JobsToken is the bearer token required by the job status API, which
+	// is disabled if it is not set.
+	JobsToken *string `hcl:"jobs_token"`
+
+	// MaxRequestSize limits the size of request bodies.  ReadTimeout limits
+	// the time taken to read a request, including its body.
+	MaxRequestSize *string `hcl:"max_request_size"`
+	ReadTimeout    *string `hcl:"read_timeout"`
+
+	// MaxConcurrency limits the number of task commands running at once.
+	// Further runs are handled according to QueuePolicy: "queue" (the
+	// default) waits for up to QueueTimeout in a queue of up to QueueSize
+	// runs, "reject" fails at once, and "coalesce", which is only valid for
+	// hooks, merges the run into the queued one and shares its result.
+	MaxConcurrency *int    `hcl:"max_concurrency"`
+	QueueSize      *int    `hcl:"queue_size"`
+	QueuePolicy    *string `hcl:"queue_policy"`
+	QueueTimeout   *string `hcl:"queue_timeout"`
 
 	EnableXRequestID *bool `hcl:"enable_xrequestid"`
 	XRequestIDLimit  *int  `hcl:"xrequestid_limit"`
@@ -32,6 +57,14 @@ type Service struct {
 	RawHooks hcl.Body `hcl:",remain"` // See https://hcl.readthedocs.io/en/latest/go_decoding_gohcl.html#partial-decoding
 
 	Hooks []Hook
+
+	// Files holds the parsed configuration files, keyed by filename, so that
+	// source text can be quoted in diagnostics.
+	Files map[string]*hcl.File
+
+	// Dir is the directory the configuration was loaded from.  Locations
+	// exposed to clients are relative to it.
+	Dir string
 }
 
 type HooksConfig struct {
@@ -43,10 +76,28 @@ type Hook struct {
 	Request       *Request `hcl:"request,block"`
 	PreExecConfig hcl.Body `hcl:",remain"`
 
-	// Request     *Request
-	Constraints *[]bool
-	Task        Task
-	Response    *Response
+	// Concurrency limits of the hook; see Service.  They are decoded with
+	// the hook, so they cannot refer to the request.
+	MaxConcurrency *int    `hcl:"max_concurrency"`
+	QueueSize      *int    `hcl:"queue_size"`
+	QueuePolicy    *string `hcl:"queue_policy"`
+	QueueTimeout   *string `hcl:"queue_timeout"`
+
+	Debounce *Debounce `hcl:"debounce,block"`
+}
+
+// Source returns the source text of the hook block's body.  It is used to
+// detect the hooks changed by a configuration reload.
+func (h *Hook) Source(files map[string]*hcl.File) []byte {
+	body, ok := h.PreExecConfig.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+	f := files[body.SrcRange.Filename]
+	if f == nil {
+		return nil
+	}
+	return body.SrcRange.SliceBytes(f.Bytes)
 }
 
 type Request struct {
@@ -55,34 +106,94 @@ type Request struct {
 	HTTPMethods                *[]string `hcl:"http_methods"`
 }
 
+// Debounce collapses bursts of requests to a hook into a single run.  A
+// request runs once no other request with the same key arrives within Window,
+// so the task uses the latest payload; the requests it superseded receive its
+// result.  Key is evaluated for each request after the constraints are
+// satisfied.  If it is not set, all requests share a key.
+type Debounce struct {
+	Window string         `hcl:"window"`
+	Key    hcl.Expression `hcl:"key"`
+}
+
+// PreExecConfig holds the constraints of a hook.  Each element of the
+// constraints list is evaluated separately; see RequestContext.EvalConstraints.
 type PreExecConfig struct {
-	Constraints    *[]bool  `hcl:"constraints"`
-	Task           Task     `hcl:"task,block"`
-	PostExecConfig hcl.Body `hcl:",remain"`
+	Constraints hcl.Expression `hcl:"constraints"`
+	ExecConfig  hcl.Body       `hcl:",remain"`
+}
+
+// ExecConfig holds the task and response blocks of a hook.  Their contents
+// are decoded separately, since the task is only evaluated if the constraints
+// are satisfied and only one response block is rendered.
+type ExecConfig struct {
+	Task           TaskBlock `hcl:"task,block"`
+	PostExecConfig hcl.Body  `hcl:",remain"`
+}
+
+// TaskBlock holds the undecoded body of a task block.
+type TaskBlock struct {
+	Body hcl.Body `hcl:",remain"`
+}
+
+// TaskFiles holds the file blocks of a task.  They are decoded before the
+// remainder of the task so that the task can refer to the created files.
+type TaskFiles struct {
+	PassFiles []PassFile `hcl:"pass_file,block"`
+	Files     []File     `hcl:"create_file,block"`
+	Task      hcl.Body   `hcl:",remain"`
 }
 
 type Task struct {
 	ExecuteCommand           []string           `hcl:"cmd"`
-	Stdin                    *string            `hcl:"stdin"`
+	Stdin                    cty.Value          `hcl:"stdin,optional"`
 	CommandWorkingDirectory  *string            `hcl:"workdir"`
 	PassEnvironmentToCommand *map[string]string `hcl:"env_vars"`
-	PassFile                 *PassFile          `hcl:"pass_file,block"`
-	File                     *File              `hcl:"create_file,block"`
+	Async                    *bool              `hcl:"async"`
+	Timeout                  *string            `hcl:"timeout"`
+	KillGracePeriod          *string            `hcl:"kill_grace_period"`
+	User                     *string            `hcl:"user"`
+	Group                    *string            `hcl:"group"`
+	Limits                   *Limits            `hcl:"limits,block"`
+	PassFiles                []PassFile         // from TaskFiles
+	Files                    []File             // from TaskFiles
 	// CaptureCommandOutput        *bool              `hcl:"capture_output"`
 	// CaptureCommandOutputOnError *bool              `hcl:"capture_outout_on_error"`
 }
 
+// Limits restricts the resources available to the task command.  Memory and
+// output sizes are given in bytes or with a unit suffix such as "512MiB".
+// Output sets the limit of each output stream, unless overridden by stdout,
+// stderr or combined.  KeepOutput selects whether the "head" or the "tail"
+// (the default) of truncated output is kept.
+type Limits struct {
+	Memory     *string `hcl:"memory"`
+	CPUTime    *string `hcl:"cpu_time"`
+	OpenFiles  *int    `hcl:"open_files"`
+	Processes  *int    `hcl:"processes"`
+	Output     *string `hcl:"output"`
+	Stdout     *string `hcl:"stdout"`
+	Stderr     *string `hcl:"stderr"`
+	Combined   *string `hcl:"combined"`
+	KeepOutput *string `hcl:"keep_output"`
+	ClearEnv   *bool   `hcl:"clear_env"`
+}
+
+// File describes a file created for the task command.  Content may be a
+// string, a bytes value or a list of byte values.
 type File struct {
-	Content  []byte  `hcl:"content"`
-	Filename string  `hcl:"filename"`
-	Keep     *bool   `hcl:"keep"`
-	EnvName  *string `hcl:"envname"`
+	Label    string    `hcl:"label,label"`
+	Content  cty.Value `hcl:"content"`
+	Filename *string   `hcl:"filename"`
+	Keep     *bool     `hcl:"keep"`
+	EnvName  *string   `hcl:"envname"`
 }
 
 type PassFile struct {
+	Label        string  `hcl:"label,label"`
 	Source       string  `hcl:"source"`
 	Name         string  `hcl:"name"`
-	Filename     string  `hcl:"filename"`
+	Filename     *string `hcl:"filename"`
 	Base64Decode *bool   `hcl:"base64decode"`
 	Keep         *bool   `hcl:"keep"`
 	EnvName      *string `hcl:"envname"`
@@ -110,6 +221,7 @@ type ResponseSuccess struct {
 	ContentType *string            `hcl:"content_type"`
 	Body        *string            `hcl:"body"`
 	Headers     *map[string]string `hcl:"headers"`
+	Stream      *bool              `hcl:"stream"`
 }
 
 type ResponseUnsatisfied struct {
@@ -127,8 +239,12 @@ func (s Service) Dump() {
 	if s.Port != nil {
 		fmt.Println("  Port: ", *s.Port)
 	}
-	fmt.Println("  Secure: ", *s.Secure)
-	fmt.Println("  NoPanic: ", *s.NoPanic)
+	if s.Secure != nil {
+		fmt.Println("  Secure: ", *s.Secure)
+	}
+	if s.NoPanic != nil {
+		fmt.Println("  NoPanic: ", *s.NoPanic)
+	}
 	if s.LogFile != nil {
 		fmt.Println("  LogFile: ", *s.LogFile)
 	}
@@ -145,74 +261,6 @@ func (s Service) Dump() {
 				fmt.Println("      JSONStringParameters:", *h.Request.JSONStringParameters)
 			}
 		}
-
-		if h.Constraints != nil {
-			fmt.Println("    Constraints:", *h.Constraints)
-		}
-
-		fmt.Println("    Task:")
-		fmt.Println("      ExecuteCommand:", h.Task.ExecuteCommand)
-		if h.Task.CommandWorkingDirectory != nil {
-			fmt.Println("      CommandWorkingDirectory:", *h.Task.CommandWorkingDirectory)
-		}
-		if h.Task.PassEnvironmentToCommand != nil {
-			fmt.Println("      PassEnvironmentToCommand:", *h.Task.PassEnvironmentToCommand)
-		}
-		if h.Task.PassFile != nil {
-			fmt.Println("      PassFile:", *h.Task.PassFile)
-		}
-		if h.Task.File != nil {
-			fmt.Println("      File:", *h.Task.File)
-		}
-
-		if h.Response != nil {
-			fmt.Println("    Response:")
-			if h.Response.ResponseSuccess != nil {
-				fmt.Println("      Success:")
-				if h.Response.ResponseSuccess.StatusCode != nil {
-					fmt.Println("        StatusCode:", *h.Response.ResponseSuccess.StatusCode)
-				}
-				if h.Response.ResponseSuccess.ContentType != nil {
-					fmt.Println("        ContentType:", *h.Response.ResponseSuccess.ContentType)
-				}
-				if h.Response.ResponseSuccess.Body != nil {
-					fmt.Println("        Body:", *h.Response.ResponseSuccess.Body)
-				}
-				if h.Response.ResponseSuccess.Headers != nil {
-					fmt.Println("        Headers:", *h.Response.ResponseSuccess.Headers)
-				}
-			}
-			if h.Response.ResponseError != nil {
-				fmt.Println("      Error:")
-				if h.Response.ResponseError.StatusCode != nil {
-					fmt.Println("        StatusCode:", *h.Response.ResponseError.StatusCode)
-				}
-				if h.Response.ResponseError.ContentType != nil {
-					fmt.Println("        ContentType:", *h.Response.ResponseError.ContentType)
-				}
-				if h.Response.ResponseError.Body != nil {
-					fmt.Println("        Body:", *h.Response.ResponseError.Body)
-				}
-				if h.Response.ResponseError.Headers != nil {
-					fmt.Println("        Headers:", *h.Response.ResponseError.Headers)
-				}
-			}
-			if h.Response.ResponseUnsatisfied != nil {
-				fmt.Println("      Unsatisfied:")
-				if h.Response.ResponseUnsatisfied.StatusCode != nil {
-					fmt.Println("        StatusCode:", *h.Response.ResponseUnsatisfied.StatusCode)
-				}
-				if h.Response.ResponseUnsatisfied.ContentType != nil {
-					fmt.Println("        ContentType:", *h.Response.ResponseUnsatisfied.ContentType)
-				}
-				if h.Response.ResponseUnsatisfied.Body != nil {
-					fmt.Println("        Body:", *h.Response.ResponseUnsatisfied.Body)
-				}
-				if h.Response.ResponseUnsatisfied.Headers != nil {
-					fmt.Println("        Headers:", *h.Response.ResponseUnsatisfied.Headers)
-				}
-			}
-		}
 		fmt.Println("")
 	}
 }
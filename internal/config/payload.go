@@ -0,0 +1,248 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// LookupPayload returns the value found by walking the dot-separated key
+// through v.  Object attributes and map keys are matched exactly before
+// falling back to a case-insensitive match.  Numeric segments index into lists
+// and tuples.
+//
+// A "*" segment matches every element of an object, map, list or tuple, and a
+// "**" segment matches zero or more levels of nesting.  If the key contains
+// either wildcard, a tuple of every matching value is returned instead.
+func LookupPayload(v cty.Value, key string) (cty.Value, error) {
+	if key == "" {
+		return v, nil
+	}
+
+	segs := strings.Split(key, ".")
+	for _, seg := range segs {
+		if seg == "*" || seg == "**" {
+			var matches []cty.Value
+			collectPayload(v, segs, &matches)
+			if len(matches) == 0 {
+				return cty.EmptyTupleVal, nil
+			}
+			return cty.TupleVal(matches), nil
+		}
+	}
+
+	for _, seg := range segs {
+		next, err := payloadStep(v, seg)
+		if err != nil {
+			return cty.NilVal, fmt.Errorf("failed to find payload value %q: %s", key, err)
+		}
+		v = next
+	}
+
+	return v, nil
+}
+
+// collectPayload appends every value matching the path segments in v to
+// matches.  Segments that do not match are skipped rather than treated as
+// errors.
+func collectPayload(v cty.Value, segs []string, matches *[]cty.Value) {
+	if len(segs) == 0 {
+		*matches = append(*matches, v)
+		return
+	}
+
+	switch segs[0] {
+	case "*":
+		for _, ev := range payloadChildren(v) {
+			collectPayload(ev, segs[1:], matches)
+		}
+	case "**":
+		collectPayload(v, segs[1:], matches)
+		for _, ev := range payloadChildren(v) {
+			collectPayload(ev, segs, matches)
+		}
+	default:
+		next, err := payloadStep(v, segs[0])
+		if err != nil {
+			return
+		}
+		collectPayload(next, segs[1:], matches)
+	}
+}
+
+// payloadChildren returns the elements of a collection or structural value.
+// Any other value has no children.
+func payloadChildren(v cty.Value) []cty.Value {
+	if v.IsNull() || !v.IsKnown() || !v.CanIterateElements() {
+		return nil
+	}
+
+	children := make([]cty.Value, 0, v.LengthInt())
+	for it := v.ElementIterator(); it.Next(); {
+		_, ev := it.Element()
+		children = append(children, ev)
+	}
+	return children
+}
+
+// DecodeJSONParameters decodes the JSON documents held in the string values
+// named by keys and replaces those strings within v with the decoded
+// structures.  Keys that are not found or that do not name a string are
+// ignored.
+func DecodeJSONParameters(v cty.Value, keys []string) (cty.Value, error) {
+	for _, key := range keys {
+		old, err := LookupPayload(v, key)
+		if err != nil || old.IsNull() || !old.IsKnown() || old.Type() != cty.String {
+			continue
+		}
+
+		nv, err := ParseJSONPayload([]byte(old.AsString()))
+		if err != nil {
+			return cty.NilVal, fmt.Errorf("json parameter %q: %s", key, err)
+		}
+
+		v, err = replacePayload(v, strings.Split(key, "."), nv)
+		if err != nil {
+			return cty.NilVal, fmt.Errorf("json parameter %q: %s", key, err)
+		}
+	}
+
+	return v, nil
+}
+
+// replacePayload returns a copy of v with the value at the path segments
+// replaced by nv.  Lists are converted to tuples, since the replacement may
+// not match the list's element type.
+func replacePayload(v cty.Value, segs []string, nv cty.Value) (cty.Value, error) {
+	if len(segs) == 0 {
+		return nv, nil
+	}
+
+	ty := v.Type()
+	switch {
+	case ty.IsObjectType(), ty.IsMapType():
+		name, err := payloadKey(v, segs[0])
+		if err != nil {
+			return cty.NilVal, err
+		}
+
+		m := make(map[string]cty.Value, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			k, ev := it.Element()
+			m[k.AsString()] = ev
+		}
+		if m[name], err = replacePayload(m[name], segs[1:], nv); err != nil {
+			return cty.NilVal, err
+		}
+		return cty.ObjectVal(m), nil
+
+	case ty.IsListType(), ty.IsTupleType():
+		if _, err := payloadStep(v, segs[0]); err != nil {
+			return cty.NilVal, err
+		}
+		i, _ := strconv.Atoi(segs[0])
+
+		elems := payloadChildren(v)
+		var err error
+		if elems[i], err = replacePayload(elems[i], segs[1:], nv); err != nil {
+			return cty.NilVal, err
+		}
+		return cty.TupleVal(elems), nil
+
+	default:
+		return cty.NilVal, fmt.Errorf("cannot access %q of %s value", segs[0], ty.FriendlyName())
+	}
+}
+
+// payloadKey returns the name of the attribute or map key of v matching seg,
+// using the same rules as payloadStep.
+func payloadKey(v cty.Value, seg string) (string, error) {
+	var names []string
+	for it := v.ElementIterator(); it.Next(); {
+		k, _ := it.Element()
+		names = append(names, k.AsString())
+	}
+
+	for _, name := range names {
+		if name == seg {
+			return name, nil
+		}
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, seg) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no key %q", seg)
+}
+
+// payloadStep returns the element of v named by a single path segment.
+func payloadStep(v cty.Value, seg string) (cty.Value, error) {
+	if v.IsNull() {
+		return cty.NilVal, fmt.Errorf("cannot access %q of null value", seg)
+	}
+	if !v.IsKnown() {
+		return cty.NilVal, fmt.Errorf("cannot access %q of unknown value", seg)
+	}
+
+	ty := v.Type()
+	switch {
+	case ty.IsObjectType():
+		if ty.HasAttribute(seg) {
+			return v.GetAttr(seg), nil
+		}
+		for name := range ty.AttributeTypes() {
+			if strings.EqualFold(name, seg) {
+				return v.GetAttr(name), nil
+			}
+		}
+		return cty.NilVal, fmt.Errorf("no attribute %q", seg)
+
+	case ty.IsMapType():
+		for it := v.ElementIterator(); it.Next(); {
+			k, ev := it.Element()
+			if k.AsString() == seg {
+				return ev, nil
+			}
+		}
+		for it := v.ElementIterator(); it.Next(); {
+			k, ev := it.Element()
+			if strings.EqualFold(k.AsString(), seg) {
+				return ev, nil
+			}
+		}
+		return cty.NilVal, fmt.Errorf("no key %q", seg)
+
+	case ty.IsListType(), ty.IsTupleType():
+		i, err := strconv.Atoi(seg)
+		if err != nil {
+			return cty.NilVal, fmt.Errorf("invalid index %q", seg)
+		}
+		if i < 0 || i >= v.LengthInt() {
+			return cty.NilVal, fmt.Errorf("index %d out of range", i)
+		}
+		return v.Index(cty.NumberIntVal(int64(i))), nil
+
+	default:
+		return cty.NilVal, fmt.Errorf("cannot access %q of %s value", seg, ty.FriendlyName())
+	}
+}
+
+// formatValue returns a JSON representation of v for debug output.
+func formatValue(v cty.Value) string {
+	if !v.IsWhollyKnown() {
+		return "(unknown)"
+	}
+	if v.Type().Equals(Bytes) && !v.IsNull() {
+		return fmt.Sprintf("(bytes[%d])", len(*v.EncapsulatedValue().(*[]byte)))
+	}
+
+	b, err := ctyjson.Marshal(v, v.Type())
+	if err != nil {
+		return fmt.Sprintf("(%s)", v.Type().FriendlyName())
+	}
+	return string(b)
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPayload = `{
+	"ref": "refs/heads/master",
+	"Repository": {"full_name": "moorereason/webhook-hcl", "private": false},
+	"commits": [
+		{"id": "a1", "author": {"name": "alice"}, "added": ["x.go"]},
+		{"id": "b2", "author": {"name": "bob"}, "added": []}
+	],
+	"headers": {"X-Token": "exact", "x-token": "lower"},
+	"empty": {}
+}`
+
+func TestLookupPayload(t *testing.T) {
+	payload, err := ParseJSONPayload([]byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want string // formatted value
+		err  string // empty if the lookup succeeds
+	}{
+		{"ref", `"refs/heads/master"`, ""},
+		{"repository.full_name", `"moorereason/webhook-hcl"`, ""},
+		{"REPOSITORY.PRIVATE", `false`, ""},
+		{"headers.X-Token", `"exact"`, ""},
+		{"headers.x-token", `"lower"`, ""},
+		{"commits.1.author.name", `"bob"`, ""},
+		{"commits.0.added.0", `"x.go"`, ""},
+		{"empty", `{}`, ""},
+
+		{"missing", "", `no attribute "missing"`},
+		{"ref.name", "", `cannot access "name" of string value`},
+		{"commits.2", "", "index 2 out of range"},
+		{"commits.-1", "", "index -1 out of range"},
+		{"commits.first", "", `invalid index "first"`},
+
+		{"commits.*.id", `["a1","b2"]`, ""},
+		{"commits.*.author.name", `["alice","bob"]`, ""},
+		{"commits.*.added.*", `["x.go"]`, ""},
+		{"*.full_name", `["moorereason/webhook-hcl"]`, ""},
+		{"commits.*.missing", `[]`, ""},
+		{"empty.*", `[]`, ""},
+		{"**.name", `["alice","bob"]`, ""},
+		{"**.id", `["a1","b2"]`, ""},
+		{"commits.**.name", `["alice","bob"]`, ""},
+		{"repository.**", `[{"full_name":"moorereason/webhook-hcl","private":false},"moorereason/webhook-hcl",false]`, ""},
+		{"**.missing", `[]`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			v, err := LookupPayload(payload, tt.key)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %s, want error %q", formatValue(v), tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatValue(v); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupPayloadEmptyKey(t *testing.T) {
+	payload, err := ParseJSONPayload([]byte(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := LookupPayload(payload, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.RawEquals(payload) {
+		t.Errorf("got %s, want the whole payload", formatValue(v))
+	}
+}
+
+func TestDecodeJSONParameters(t *testing.T) {
+	const payload = `{"a":{"b":"{\"c\":[1,\"d\"]}","n":1},"list":["{\"x\":true}","oops"],"bad":"{\"c\":"}`
+
+	tests := []struct {
+		name string
+		keys []string
+		want string // formatted value
+		err  string // empty if decoding succeeds
+	}{
+		{"nested string", []string{"a.b"},
+			`{"a":{"b":{"c":[1,"d"]},"n":1},"bad":"{\"c\":","list":["{\"x\":true}","oops"]}`, ""},
+		{"list element", []string{"list.0"},
+			`{"a":{"b":"{\"c\":[1,\"d\"]}","n":1},"bad":"{\"c\":","list":[{"x":true},"oops"]}`, ""},
+		{"several keys", []string{"a.b", "list.0"},
+			`{"a":{"b":{"c":[1,"d"]},"n":1},"bad":"{\"c\":","list":[{"x":true},"oops"]}`, ""},
+		{"missing path", []string{"a.missing", "missing.b", "list.5"},
+			`{"a":{"b":"{\"c\":[1,\"d\"]}","n":1},"bad":"{\"c\":","list":["{\"x\":true}","oops"]}`, ""},
+		{"not a string", []string{"a.n", "a"},
+			`{"a":{"b":"{\"c\":[1,\"d\"]}","n":1},"bad":"{\"c\":","list":["{\"x\":true}","oops"]}`, ""},
+		{"invalid json", []string{"bad"}, "", `json parameter "bad"`},
+		{"invalid json in list", []string{"list.1"}, "", `json parameter "list.1"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := ParseJSONPayload([]byte(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, err = DecodeJSONParameters(v, tt.keys)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %s, want error %q", formatValue(v), tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatValue(v); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Credential identifies the user and groups a command runs as.
+type Credential struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+}
+
+// LookupCredential resolves a user and group, given by name or numeric ID, to
+// a Credential.  If groupName is empty, the user's primary group is used.  If
+// userName is empty, the command runs as the current user with the given
+// group.
+func LookupCredential(userName, groupName string) (*Credential, error) {
+	if userName == "" && groupName == "" {
+		return nil, fmt.Errorf("user or group is required")
+	}
+
+	c := &Credential{
+		UID: uint32(os.Getuid()),
+		GID: uint32(os.Getgid()),
+	}
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if _, nerr := strconv.Atoi(userName); nerr != nil {
+				return nil, err
+			}
+			if u, err = user.LookupId(userName); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.UID, err = parseID(u.Uid); err != nil {
+			return nil, fmt.Errorf("user %q: %s", userName, err)
+		}
+		if c.GID, err = parseID(u.Gid); err != nil {
+			return nil, fmt.Errorf("user %q: %s", userName, err)
+		}
+
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %s", userName, err)
+		}
+		for _, id := range gids {
+			gid, err := parseID(id)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %s", userName, err)
+			}
+			c.Groups = append(c.Groups, gid)
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if _, nerr := strconv.Atoi(groupName); nerr != nil {
+				return nil, err
+			}
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.GID, err = parseID(g.Gid); err != nil {
+			return nil, fmt.Errorf("group %q: %s", groupName, err)
+		}
+		if userName == "" {
+			c.Groups = []uint32{c.GID}
+		}
+	}
+
+	return c, nil
+}
+
+func parseID(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", s)
+	}
+	return uint32(n), nil
+}
@@ -0,0 +1,409 @@
+// Package executor runs the commands of hook tasks.
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultKillGracePeriod is the time a timed out command is given to exit
+// after SIGTERM before it is sent SIGKILL.
+const DefaultKillGracePeriod = 5 * time.Second
+
+// DefaultOutputLimit is the number of bytes captured from each output stream
+// of a command if no limit is set.
+const DefaultOutputLimit = 1 << 20
+
+// Command describes a command to execute.
+type Command struct {
+	// Args holds the command name and its arguments.
+	Args []string
+
+	// Dir is the working directory of the command.  If empty, the command
+	// runs in the current directory.
+	Dir string
+
+	// Env holds variables added to the environment inherited from the
+	// webhook process.
+	Env map[string]string
+
+	// ClearEnv prevents the command from inheriting the environment of the
+	// webhook process, so that its environment holds only Env.
+	ClearEnv bool
+
+	// Stdin is fed to the command's standard input.
+	Stdin []byte
+
+	// Stdout, if set, receives the command's standard output as it is
+	// produced, in addition to it being captured in the Result.  Write
+	// errors stop the command's output, so Stdout should not fail.
+	Stdout io.Writer
+
+	// Timeout limits the run time of the command, including the time its
+	// output stays open.  If zero, the command may run indefinitely.
+	Timeout time.Duration
+
+	// KillGracePeriod is the time given to the command's process group to
+	// exit after SIGTERM is sent on timeout.  Any processes remaining
+	// afterward are sent SIGKILL, and the output of processes that left
+	// the group is no longer read.  If zero, DefaultKillGracePeriod is
+	// used.
+	KillGracePeriod time.Duration
+
+	// Credential sets the user and groups the command runs as.  If nil,
+	// the command runs as the webhook process's user.
+	Credential *Credential
+
+	// Limits restricts the resources available to the command.
+	Limits Limits
+}
+
+// Limits describes the resource limits of a command.  Zero values are
+// unlimited, except for the output limits, which default to
+// DefaultOutputLimit.
+type Limits struct {
+	// Memory limits the virtual memory size of each process, in bytes.
+	Memory uint64
+
+	// CPUTime limits the CPU time consumed by each process.  The limit is
+	// rounded up to a whole second.
+	CPUTime time.Duration
+
+	// OpenFiles limits the number of file descriptors each process may
+	// open.
+	OpenFiles uint64
+
+	// Processes limits the number of processes owned by the command's
+	// user.  The limit is not enforced for root.
+	Processes uint64
+
+	// Stdout, Stderr and Combined limit the number of bytes captured from
+	// the command's standard output, its standard error and the two
+	// interleaved.  Once a limit is reached, the oldest output is
+	// discarded, unless OutputHead is set, in which case further output
+	// is discarded.
+	Stdout   int
+	Stderr   int
+	Combined int
+
+	OutputHead bool
+}
+
+// Result describes a completed command.
+type Result struct {
+	ExitCode int
+	PID      int
+
+	Stdout   []byte
+	Stderr   []byte
+	Combined []byte
+
+	Started  time.Time
+	Duration time.Duration
+
+	// TimedOut is set if the command was killed because it exceeded its
+	// timeout.
+	TimedOut bool
+
+	// Truncated is set if any output was discarded because it exceeded an
+	// output limit.
+	Truncated bool
+
+	// Err is set if the command could not be started or did not exit
+	// successfully.
+	Err error
+}
+
+// Run executes the command and waits for it to complete.
+func Run(c Command) *Result {
+	res := &Result{
+		ExitCode: -1,
+		Started:  time.Now(),
+	}
+
+	cmd := exec.Command(c.Args[0], c.Args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = environ(c.Env, c.ClearEnv)
+
+	stdout := newOutputBuffer(c.Limits.Stdout, c.Limits.OutputHead)
+	stderr := newOutputBuffer(c.Limits.Stderr, c.Limits.OutputHead)
+	combined := newOutputBuffer(c.Limits.Combined, c.Limits.OutputHead)
+	outw := io.MultiWriter(stdout, combined)
+	if c.Stdout != nil {
+		outw = io.MultiWriter(stdout, combined, c.Stdout)
+	}
+
+	p, err := newPipes(cmd, c.Stdin, outw, io.MultiWriter(stderr, combined))
+	if err != nil {
+		res.Err = err
+		res.Duration = time.Since(res.Started)
+		return res
+	}
+	// fail reports an error that prevented the command from starting.
+	fail := func(err error) *Result {
+		p.started()
+		p.close()
+		p.wait()
+		res.Err = err
+		res.Duration = time.Since(res.Started)
+		return res
+	}
+
+	setProcessGroup(cmd)
+	if c.Credential != nil {
+		if err := setCredential(cmd, c.Credential); err != nil {
+			return fail(err)
+		}
+	}
+	// The limits helper takes over the credential.
+	if err := setLimits(cmd, c.Limits); err != nil {
+		return fail(fmt.Errorf("error setting resource limits: %s", err))
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+	p.started()
+	res.PID = cmd.Process.Pid
+
+	// The command is done once it has exited and its output is closed.
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		p.wait()
+		done <- err
+	}()
+
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		t := time.NewTimer(c.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case res.Err = <-done:
+	case <-timeout:
+		res.TimedOut = true
+		terminate(cmd, done, c.KillGracePeriod, p.close)
+		res.Err = fmt.Errorf("command timed out after %s", c.Timeout)
+	}
+
+	res.Duration = time.Since(res.Started)
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	res.Stdout = stdout.Bytes()
+	res.Stderr = stderr.Bytes()
+	res.Combined = combined.Bytes()
+	res.Truncated = stdout.Truncated() || stderr.Truncated() || combined.Truncated()
+
+	return res
+}
+
+// terminate sends SIGTERM to the command's process group and waits for the
+// command to be done.  If it is not done after the grace period, the group is
+// sent SIGKILL and abandon is called to close the command's output, which
+// processes that left the group may still hold open.
+func terminate(cmd *exec.Cmd, done <-chan error, grace time.Duration, abandon func()) {
+	if grace <= 0 {
+		grace = DefaultKillGracePeriod
+	}
+
+	signalGroup(cmd.Process, syscall.SIGTERM)
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-t.C:
+	}
+
+	signalGroup(cmd.Process, syscall.SIGKILL)
+	abandon()
+	<-done
+}
+
+// pipes connects the standard streams of a command.  Unlike the pipes of the
+// exec package, whose Wait blocks until every process holding an output pipe
+// has closed it, their ends in the webhook process can be closed to abandon
+// processes that escaped the command's process group.
+type pipes struct {
+	child  []*os.File // passed to the command
+	parent []*os.File
+	wg     sync.WaitGroup
+}
+
+// newPipes connects stdin, if not nil, and the output writers to cmd.
+func newPipes(cmd *exec.Cmd, stdin []byte, stdout, stderr io.Writer) (*pipes, error) {
+	p := &pipes{}
+	var err error
+	if stdin != nil {
+		if cmd.Stdin, err = p.input(stdin); err != nil {
+			p.started()
+			p.close()
+			return nil, err
+		}
+	}
+	if cmd.Stdout, err = p.output(stdout); err == nil {
+		cmd.Stderr, err = p.output(stderr)
+	}
+	if err != nil {
+		p.started()
+		p.close()
+		p.wait()
+		return nil, err
+	}
+	return p, nil
+}
+
+// input returns a pipe fed with b.
+func (p *pipes) input(b []byte) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.child = append(p.child, r)
+	p.parent = append(p.parent, w)
+
+	go func() {
+		w.Write(b)
+		w.Close()
+	}()
+	return r, nil
+}
+
+// output returns a pipe copied to w until it is closed.
+func (p *pipes) output(w io.Writer) (*os.File, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.child = append(p.child, pw)
+	p.parent = append(p.parent, r)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		io.Copy(w, r)
+	}()
+	return pw, nil
+}
+
+// started closes the ends passed to the command once it has started, so that
+// the output ends at the exit of the last process holding them.
+func (p *pipes) started() {
+	for _, f := range p.child {
+		f.Close()
+	}
+}
+
+// close closes the webhook process's ends, discarding any further output.
+func (p *pipes) close() {
+	for _, f := range p.parent {
+		f.Close()
+	}
+}
+
+// wait blocks until the output has been copied.
+func (p *pipes) wait() {
+	p.wg.Wait()
+}
+
+// environ returns the environment of the webhook process with env added.  If
+// clear is set, only env is returned.
+func environ(env map[string]string, clear bool) []string {
+	var e []string
+	if !clear {
+		e = os.Environ()
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e = append(e, k+"="+env[k])
+	}
+	return e
+}
+
+// outputBuffer captures up to max bytes of output.  It is safe for concurrent
+// writes, so that stdout and stderr can be interleaved into a single stream.
+// Once max bytes have been written, either the first or the last max bytes are
+// kept, depending on head.
+type outputBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	head      bool
+	truncated bool
+}
+
+func newOutputBuffer(max int, head bool) *outputBuffer {
+	if max <= 0 {
+		max = DefaultOutputLimit
+	}
+	return &outputBuffer{max: max, head: head}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	if b.head {
+		if room := b.max - len(b.buf); room < len(p) {
+			p = p[:room]
+			b.truncated = true
+		}
+		b.buf = append(b.buf, p...)
+		return n, nil
+	}
+
+	if len(p) > b.max {
+		p = p[len(p)-b.max:]
+		b.buf = b.buf[:0]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.truncated = true
+		// Discard the excess once it matches the kept output in size, so
+		// the buffer never holds more than twice max bytes.
+		if len(b.buf) >= 2*b.max {
+			b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the kept output.
+func (b *outputBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buf := b.buf
+	if len(buf) > b.max {
+		buf = buf[len(buf)-b.max:]
+	}
+	return append([]byte(nil), buf...)
+}
+
+// Truncated reports whether any output was discarded.
+func (b *outputBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.truncated
+}
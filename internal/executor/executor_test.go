@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a Unix shell")
+	}
+	for _, name := range []string{"sh", "sleep", "setsid", "cat"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		timeout  time.Duration
+		grace    time.Duration
+		timedOut bool
+		exitCode int
+		stdout   string
+		max      time.Duration // upper bound of the run time
+	}{
+		{"exits in time", []string{"sh", "-c", "echo hi; exit 3"}, "", time.Second, 0, false, 3, "hi\n", time.Second},
+		{"stdin", []string{"cat"}, "abc", time.Second, 0, false, 0, "abc", time.Second},
+		{"no timeout", []string{"sh", "-c", "echo hi >&2"}, "", 0, 0, false, 0, "", time.Second},
+		{"stops on SIGTERM", []string{"sh", "-c", "echo start; sleep 10"}, "", 100 * time.Millisecond, 5 * time.Second, true, -1, "start\n", time.Second},
+		{"ignores SIGTERM", []string{"sh", "-c", "trap '' TERM; sleep 10"}, "", 100 * time.Millisecond, 200 * time.Millisecond, true, -1, "", time.Second},
+		// The grandchild leaves the process group but keeps the output
+		// open; it is abandoned once the grace period ends.
+		{"escaped grandchild", []string{"sh", "-c", "setsid sleep 3 & sleep 60"}, "", 300 * time.Millisecond, 200 * time.Millisecond, true, -1, "", 2 * time.Second},
+		{"escaped grandchild after exit", []string{"sh", "-c", "setsid sleep 3 &"}, "", 300 * time.Millisecond, 200 * time.Millisecond, true, 0, "", 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Command{
+				Args:            tt.args,
+				Timeout:         tt.timeout,
+				KillGracePeriod: tt.grace,
+			}
+			if tt.stdin != "" {
+				c.Stdin = []byte(tt.stdin)
+			}
+
+			start := time.Now()
+			res := Run(c)
+			elapsed := time.Since(start)
+
+			if elapsed > tt.max {
+				t.Errorf("Run took %s, want at most %s", elapsed, tt.max)
+			}
+			if res.TimedOut != tt.timedOut {
+				t.Errorf("TimedOut = %t, want %t (error: %v)", res.TimedOut, tt.timedOut, res.Err)
+			}
+			if res.ExitCode != tt.exitCode {
+				t.Errorf("ExitCode = %d, want %d", res.ExitCode, tt.exitCode)
+			}
+			if got := string(res.Stdout); got != tt.stdout {
+				t.Errorf("Stdout = %q, want %q", got, tt.stdout)
+			}
+		})
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		head      bool
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{"head under limit", 8, true, []string{"abc", "def"}, "abcdef", false},
+		{"head at limit", 6, true, []string{"abc", "def"}, "abcdef", false},
+		{"head over limit", 4, true, []string{"abc", "def"}, "abcd", true},
+		{"head single large write", 3, true, []string{"abcdef"}, "abc", true},
+		{"head writes after full", 3, true, []string{"abc", "d", "e"}, "abc", true},
+		{"head empty writes", 3, true, []string{"", "ab", ""}, "ab", false},
+
+		{"tail under limit", 8, false, []string{"abc", "def"}, "abcdef", false},
+		{"tail at limit", 6, false, []string{"abc", "def"}, "abcdef", false},
+		{"tail over limit", 4, false, []string{"abc", "def"}, "cdef", true},
+		{"tail single large write", 3, false, []string{"abcdef"}, "def", true},
+		{"tail large write after small", 3, false, []string{"ab", "cdefgh"}, "fgh", true},
+		{"tail many small writes", 3, false, strings.Split("abcdefghij", ""), "hij", true},
+		{"tail compacts excess", 2, false, []string{"ab", "cd", "e"}, "de", true},
+
+		{"default limit", 0, true, []string{"abc"}, "abc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newOutputBuffer(tt.max, tt.head)
+			for _, w := range tt.writes {
+				n, err := b.Write([]byte(w))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(w) {
+					t.Fatalf("Write(%q) = %d, want %d", w, n, len(w))
+				}
+			}
+
+			if got := string(b.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+			if got := b.Truncated(); got != tt.truncated {
+				t.Errorf("Truncated() = %t, want %t", got, tt.truncated)
+			}
+			if len(b.buf) > 2*b.max {
+				t.Errorf("buffer holds %d bytes, want at most %d", len(b.buf), 2*b.max)
+			}
+		})
+	}
+}
+
+func TestOutputBufferBytesIsCopy(t *testing.T) {
+	b := newOutputBuffer(4, false)
+	b.Write([]byte("abcd"))
+	out := b.Bytes()
+	out[0] = 'x'
+	if got := string(b.Bytes()); got != "abcd" {
+		t.Errorf("Bytes() = %q after modifying a previous result, want %q", got, "abcd")
+	}
+}
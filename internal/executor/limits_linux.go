@@ -0,0 +1,201 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Environment variables passing the resource limits, the credential and the
+// command path to the limits helper.  See setLimits.  They are removed from
+// the environment of the command.
+const (
+	rlimitsEnv    = "WEBHOOK_HCL_RLIMITS"
+	credentialEnv = "WEBHOOK_HCL_CREDENTIAL"
+	execEnv       = "WEBHOOK_HCL_EXEC"
+)
+
+// helperArg0 is the argv[0] of the limits helper.  The helper only runs if it
+// is set along with execEnv, so that the variable alone, such as when
+// inherited from a parent process, does not divert the webhook binary.
+const helperArg0 = "webhook-hcl-limits"
+
+// selfExe refers to the running executable.  The limits helper runs it as the
+// user of the webhook process, which switches to the command's credential
+// only once the limits are applied, so the binary need not be executable by
+// that user.
+const selfExe = "/proc/self/exe"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == helperArg0 && os.Getenv(execEnv) != "" {
+		execLimited()
+	}
+}
+
+// setLimits arranges for the resource limits of l to be applied to the
+// command before it executes, so that they hold from its first instruction and
+// are inherited by every process it forks.
+//
+// The exec package provides no way to run code between fork and exec, so the
+// command is started through this executable, which applies the limits to
+// itself, switches to the credential set by setCredential, if any, and then
+// executes the command in its place; see execLimited.
+func setLimits(cmd *exec.Cmd, l Limits) error {
+	var rlimits []string
+	add := func(resource int, value uint64) {
+		rlimits = append(rlimits, fmt.Sprintf("%d=%d", resource, value))
+	}
+
+	if l.OpenFiles > 0 {
+		add(unix.RLIMIT_NOFILE, l.OpenFiles)
+	}
+	if l.Processes > 0 {
+		add(unix.RLIMIT_NPROC, l.Processes)
+	}
+	if l.CPUTime > 0 {
+		// RLIMIT_CPU has a granularity of one second; round up.
+		add(unix.RLIMIT_CPU, uint64((l.CPUTime+999999999)/1000000000))
+	}
+	if l.Memory > 0 {
+		// The address space limit is applied last, as it may leave the
+		// helper unable to allocate.
+		add(unix.RLIMIT_AS, l.Memory)
+	}
+	if len(rlimits) == 0 {
+		return nil
+	}
+
+	// Report missing commands here rather than from the helper.
+	if !strings.Contains(cmd.Path, "/") {
+		if _, err := exec.LookPath(cmd.Path); err != nil {
+			return err
+		}
+	}
+
+	env := append(cmd.Env,
+		rlimitsEnv+"="+strings.Join(rlimits, ","),
+		execEnv+"="+cmd.Path,
+	)
+	if attr := cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		env = append(env, credentialEnv+"="+formatCredential(attr.Credential))
+		attr.Credential = nil
+	}
+	cmd.Env = env
+	cmd.Path = selfExe
+	cmd.Args = append([]string{helperArg0}, cmd.Args...)
+	return nil
+}
+
+// formatCredential encodes c as "uid:gid:group,...".
+func formatCredential(c *syscall.Credential) string {
+	groups := make([]string, len(c.Groups))
+	for i, g := range c.Groups {
+		groups[i] = strconv.FormatUint(uint64(g), 10)
+	}
+	return fmt.Sprintf("%d:%d:%s", c.Uid, c.Gid, strings.Join(groups, ","))
+}
+
+// parseCredential decodes a credential encoded by formatCredential.
+func parseCredential(s string) (uid, gid int, groups []int, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, 0, nil, fmt.Errorf("invalid credential %q", s)
+	}
+	if uid, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, nil, err
+	}
+	if gid, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, nil, err
+	}
+	groups = []int{}
+	if parts[2] != "" {
+		for _, g := range strings.Split(parts[2], ",") {
+			n, err := strconv.Atoi(g)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			groups = append(groups, n)
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// execLimited runs in the limits helper started by setLimits.  It applies the
+// resource limits to the current process, switches to the command's
+// credential, if any, and executes the command with its original arguments
+// and environment.  It does not return.
+func execLimited() {
+	path := os.Getenv(execEnv)
+	rlimits := os.Getenv(rlimitsEnv)
+	cred := os.Getenv(credentialEnv)
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, rlimitsEnv+"=") && !strings.HasPrefix(e, credentialEnv+"=") &&
+			!strings.HasPrefix(e, execEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	if env == nil {
+		env = []string{}
+	}
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "error setting resource limits: %s\n", err)
+		os.Exit(127)
+	}
+
+	// The credential of the thread executing the command is the one that
+	// counts.
+	runtime.LockOSThread()
+
+	var uid, gid int
+	var groups []int
+	if cred != "" {
+		var err error
+		if uid, gid, groups, err = parseCredential(cred); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, r := range strings.Split(rlimits, ",") {
+		i := strings.IndexByte(r, '=')
+		if i < 0 {
+			fail(fmt.Errorf("invalid limit %q", r))
+		}
+		resource, err := strconv.Atoi(r[:i])
+		if err != nil {
+			fail(err)
+		}
+		value, err := strconv.ParseUint(r[i+1:], 10, 64)
+		if err != nil {
+			fail(err)
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			fail(err)
+		}
+	}
+
+	if cred != "" {
+		if err := unix.Setgroups(groups); err != nil {
+			fail(fmt.Errorf("setgroups: %s", err))
+		}
+		if err := unix.Setresgid(gid, gid, gid); err != nil {
+			fail(fmt.Errorf("setgid: %s", err))
+		}
+		if err := unix.Setresuid(uid, uid, uid); err != nil {
+			fail(fmt.Errorf("setuid: %s", err))
+		}
+	}
+
+	if err := unix.Exec(path, os.Args[1:], env); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		os.Exit(127)
+	}
+}
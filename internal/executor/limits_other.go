@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setLimits fails if any resource limit is set, since they are only
+// supported on Linux.
+func setLimits(cmd *exec.Cmd, l Limits) error {
+	if l.Memory > 0 || l.CPUTime > 0 || l.OpenFiles > 0 || l.Processes > 0 {
+		return errors.New("resource limits are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup places the command in a new process group so that it can
+// be signaled along with any children it spawns.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// setCredential runs the command as the user and groups of c.
+func setCredential(cmd *exec.Cmd, c *Credential) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    c.UID,
+		Gid:    c.GID,
+		Groups: c.Groups,
+	}
+	return nil
+}
+
+// signalGroup sends sig to the process group led by p.
+func signalGroup(p *os.Process, sig syscall.Signal) {
+	syscall.Kill(-p.Pid, sig)
+}
@@ -0,0 +1,23 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// setCredential fails on Windows, which does not support running commands as
+// another user.
+func setCredential(cmd *exec.Cmd, c *Credential) error {
+	return errors.New("running commands as another user is not supported on Windows")
+}
+
+// signalGroup kills p.  Windows does not support sending signals, so the
+// process is killed regardless of sig.
+func signalGroup(p *os.Process, sig syscall.Signal) {
+	p.Kill()
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+)
+
+// Queue policies applied once max_concurrency runs are in progress.
+const (
+	policyQueue    = "queue"
+	policyReject   = "reject"
+	policyCoalesce = "coalesce"
+)
+
+// defaultQueueSize is the number of runs that may wait for a free slot if
+// queue_size is not set.
+const defaultQueueSize = 100
+
+// limitError is returned for runs that a limiter does not admit.  Status is the
+// HTTP status code of the response.
+type limitError struct {
+	status int
+	msg    string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// share holds the result of a queued run that later runs were coalesced into.
+type share struct {
+	done chan struct{}
+	res  *executor.Result
+}
+
+func newShare() *share {
+	return &share{done: make(chan struct{})}
+}
+
+// publish records the result of the run and wakes the waiting runs.
+func (sh *share) publish(res *executor.Result) {
+	sh.res = res
+	close(sh.done)
+}
+
+// wait blocks until the run completes and returns its result.
+func (sh *share) wait() *executor.Result {
+	<-sh.done
+	return sh.res
+}
+
+// limiter bounds the number of concurrent runs.  A nil limiter admits every
+// run.
+type limiter struct {
+	max       int
+	queueSize int
+	policy    string
+	timeout   time.Duration
+	status    int
+
+	mu      sync.Mutex
+	running int
+	queue   []chan struct{}
+	pending *share // coalesce only: the share of the queued run
+}
+
+// newLimiter returns a limiter for the given attributes, or nil if max is not
+// set.  Rejected runs are answered with status.  coalesce reports whether the
+// coalesce policy is allowed.
+func newLimiter(max, queueSize *int, policy, timeout *string, status int, coalesce bool) (*limiter, error) {
+	if max == nil {
+		if queueSize != nil || policy != nil || timeout != nil {
+			return nil, fmt.Errorf("queue_size, queue_policy and queue_timeout require max_concurrency")
+		}
+		return nil, nil
+	}
+
+	l := &limiter{
+		max:       *max,
+		queueSize: defaultQueueSize,
+		policy:    policyQueue,
+		status:    status,
+	}
+	if l.max < 1 {
+		return nil, fmt.Errorf("max_concurrency must be at least 1")
+	}
+	if queueSize != nil {
+		l.queueSize = *queueSize
+	}
+	if l.queueSize < 0 {
+		return nil, fmt.Errorf("queue_size must not be negative")
+	}
+	if policy != nil {
+		l.policy = *policy
+	}
+	switch l.policy {
+	case policyQueue, policyReject:
+	case policyCoalesce:
+		if !coalesce {
+			return nil, fmt.Errorf("queue_policy %q is only valid for hooks", l.policy)
+		}
+	default:
+		return nil, fmt.Errorf("unknown queue_policy %q", l.policy)
+	}
+	if timeout != nil {
+		d, err := time.ParseDuration(*timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue_timeout: %s", err)
+		}
+		l.timeout = d
+	}
+
+	return l, nil
+}
+
+// sameAs reports whether l and o have the same settings, in which case l may
+// be replaced by o when the configuration is reloaded.
+func (l *limiter) sameAs(o *limiter) bool {
+	if l == nil || o == nil {
+		return l == o
+	}
+	return l.max == o.max && l.queueSize == o.queueSize && l.policy == o.policy &&
+		l.timeout == o.timeout && l.status == o.status
+}
+
+// ticket is a run entered into a limiter.  A queued ticket must wait to be
+// admitted, and an admitted ticket must be released once its run completes.
+// The nil ticket of a nil limiter is admitted at once.
+type ticket struct {
+	l     *limiter
+	ready chan struct{} // set if queued
+	own   *share        // coalesce only: the share the run publishes to
+	share *share        // set if coalesced into the queued run
+}
+
+// enter admits a run at once if a slot is free.  Otherwise, according to the
+// policy, the run is rejected with a *limitError, coalesced into the queued
+// run, in which case the ticket's share receives that run's result, or
+// queued.  enter does not block.
+func (l *limiter) enter() (*ticket, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.running < l.max {
+		l.running++
+		return &ticket{l: l}, nil
+	}
+
+	var own *share
+	switch l.policy {
+	case policyReject:
+		return nil, &limitError{l.status, "Too many concurrent runs."}
+	case policyCoalesce:
+		// At most one run waits; later runs share its result.
+		if l.pending != nil {
+			return &ticket{share: l.pending}, nil
+		}
+		own = newShare()
+		l.pending = own
+	default:
+		if len(l.queue) >= l.queueSize {
+			return nil, &limitError{l.status, "Too many queued runs."}
+		}
+	}
+
+	t := &ticket{l: l, ready: make(chan struct{}), own: own}
+	l.queue = append(l.queue, t.ready)
+	return t, nil
+}
+
+// queued reports whether the run must wait, either to be admitted or for the
+// result of the run it was coalesced into.
+func (t *ticket) queued() bool {
+	return t != nil && (t.ready != nil || t.share != nil)
+}
+
+// wait blocks until a queued ticket is admitted.  It fails with a *limitError
+// if the queue timeout passes first.  It must not be called for a coalesced
+// ticket.
+func (t *ticket) wait() error {
+	if t == nil || t.ready == nil {
+		return nil
+	}
+	l := t.l
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		tm := time.NewTimer(l.timeout)
+		defer tm.Stop()
+		timeout = tm.C
+	}
+
+	select {
+	case <-t.ready:
+	case <-timeout:
+		l.mu.Lock()
+		if l.dequeue(t.ready) {
+			if t.own != nil {
+				l.pending = nil
+			}
+			l.mu.Unlock()
+
+			err := &limitError{l.status, "Timed out waiting to run."}
+			if t.own != nil {
+				t.own.publish(&executor.Result{ExitCode: -1, Err: err})
+			}
+			return err
+		}
+		// The slot was handed over as the timer fired.
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// release frees the slot of an admitted ticket.  The slot is handed to the
+// first queued ticket, if any.  res is published to the runs coalesced into
+// this one.
+func (t *ticket) release(res *executor.Result) {
+	if t == nil {
+		return
+	}
+	l := t.l
+
+	l.mu.Lock()
+	if len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		l.pending = nil
+	} else {
+		l.running--
+	}
+	l.mu.Unlock()
+
+	if t.own != nil {
+		t.own.publish(res)
+	}
+}
+
+// dequeue removes ready from the queue and reports whether it was queued.
+func (l *limiter) dequeue(ready chan struct{}) bool {
+	for i, c := range l.queue {
+		if c == ready {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newLimiters returns the service limiter and the limiter of each hook.
+// Hooks that are over their own limit are answered with 429 Too Many
+// Requests; runs over the service limit with 503 Service Unavailable.
+func newLimiters(conf config.Service) (*limiter, map[string]*limiter, error) {
+	sl, err := newLimiter(conf.MaxConcurrency, conf.QueueSize, conf.QueuePolicy, conf.QueueTimeout, http.StatusServiceUnavailable, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hooks := make(map[string]*limiter, len(conf.Hooks))
+	for _, h := range conf.Hooks {
+		l, err := newLimiter(h.MaxConcurrency, h.QueueSize, h.QueuePolicy, h.QueueTimeout, http.StatusTooManyRequests, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("hook %q: %s", h.ID, err)
+		}
+		hooks[h.ID] = l
+	}
+
+	return sl, hooks, nil
+}
+
+// admission is a run of a hook entered into the hook and service limiters.
+type admission struct {
+	s       *Server
+	hook    *ticket
+	service *ticket
+	entered bool // whether the service limiter was entered
+}
+
+// enter enters a run of h into the limiters without waiting.  Runs rejected
+// by either limiter fail with a *limitError.  The service limiter is only
+// entered once the hook limiter admits the run, so that runs queued for a
+// busy hook do not hold a service slot.
+func (s *Server) enter(h *config.Hook) (*admission, error) {
+	ht, err := s.hookLimits[h.ID].enter()
+	if err != nil {
+		return nil, err
+	}
+	a := &admission{s: s, hook: ht}
+	if ht.queued() {
+		return a, nil
+	}
+
+	if a.service, err = s.limits.enter(); err != nil {
+		ht.release(&executor.Result{ExitCode: -1, Err: err})
+		return nil, err
+	}
+	a.entered = true
+	return a, nil
+}
+
+// queued reports whether wait may block.
+func (a *admission) queued() bool {
+	return a.hook.queued() || a.service.queued()
+}
+
+// wait blocks until both limiters admit the run.  An admitted run must call
+// release with its result once it completes.  A run coalesced into the queued
+// run of its hook receives that run's share instead, and release is nil.
+func (a *admission) wait() (release func(*executor.Result), sh *share, err error) {
+	if a.hook != nil && a.hook.share != nil {
+		return nil, a.hook.share, nil
+	}
+	if err := a.hook.wait(); err != nil {
+		return nil, nil, err
+	}
+
+	fail := func(err error) (func(*executor.Result), *share, error) {
+		a.hook.release(&executor.Result{ExitCode: -1, Err: err})
+		return nil, nil, err
+	}
+	if !a.entered {
+		if a.service, err = a.s.limits.enter(); err != nil {
+			return fail(err)
+		}
+		a.entered = true
+	}
+	if err := a.service.wait(); err != nil {
+		return fail(err)
+	}
+
+	return func(res *executor.Result) {
+		a.service.release(res)
+		a.hook.release(res)
+	}, nil, nil
+}
+
+// admitted waits for a run entered with enter, which failed with err if set,
+// to be admitted.  If the run is rejected or coalesced into a queued run, the
+// job's files are removed and the job finishes; its result is returned.
+// Otherwise release must be called with the result of the run.
+func (s *Server) admitted(h *config.Hook, jobID string, files fileSet, a *admission, err error) (release func(*executor.Result), res *executor.Result) {
+	var sh *share
+	if err == nil {
+		release, sh, err = a.wait()
+	}
+
+	switch {
+	case err != nil:
+		files.remove()
+		log.Printf("hook %q: job %s: %s", h.ID, jobID, err)
+		res = &executor.Result{ExitCode: -1, Err: err}
+		s.jobs.finish(jobID, res)
+		return nil, res
+	case sh != nil:
+		files.remove()
+		s.logf("hook %q: job %s: coalesced into the queued run", h.ID, jobID)
+		res = sh.wait()
+		s.jobs.finish(jobID, res)
+		return nil, res
+	}
+	return release, nil
+}
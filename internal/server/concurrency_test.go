@@ -0,0 +1,235 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/executor"
+)
+
+func testLimiter(t *testing.T, max, queueSize int, policy, timeout string) *limiter {
+	t.Helper()
+	var tp *string
+	if timeout != "" {
+		tp = &timeout
+	}
+	l, err := newLimiter(&max, &queueSize, &policy, tp, http.StatusTooManyRequests, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// outcome describes the result of entering a run into a limiter.
+func outcome(tk *ticket, err error) string {
+	switch {
+	case err != nil:
+		le, ok := err.(*limitError)
+		if !ok || le.status != http.StatusTooManyRequests {
+			return "unexpected error: " + err.Error()
+		}
+		return "rejected: " + le.msg
+	case tk.share != nil:
+		return "coalesced"
+	case tk.ready != nil:
+		return "queued"
+	default:
+		return "admitted"
+	}
+}
+
+// waitDone reports whether done is closed within a short time.
+func waitDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func (l *limiter) state() (running, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running, len(l.queue)
+}
+
+func TestLimiterEnter(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		queueSize int
+		policy    string
+		want      []string
+	}{
+		{"queue", 2, 1, policyQueue, []string{"admitted", "admitted", "queued", "rejected: Too many queued runs."}},
+		{"queue without room", 1, 0, policyQueue, []string{"admitted", "rejected: Too many queued runs."}},
+		{"reject", 1, 5, policyReject, []string{"admitted", "rejected: Too many concurrent runs.", "rejected: Too many concurrent runs."}},
+		{"coalesce", 1, 0, policyCoalesce, []string{"admitted", "queued", "coalesced", "coalesced"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testLimiter(t, tt.max, tt.queueSize, tt.policy, "")
+			for i, want := range tt.want {
+				if got := outcome(l.enter()); got != want {
+					t.Errorf("run %d: %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *limiter
+	tk, err := l.enter()
+	if err != nil || tk.queued() {
+		t.Fatalf("nil limiter: enter = %v, %v; want an admitted ticket", tk, err)
+	}
+	if err := tk.wait(); err != nil {
+		t.Fatal(err)
+	}
+	tk.release(&executor.Result{})
+}
+
+func TestLimiterQueue(t *testing.T) {
+	l := testLimiter(t, 1, 10, policyQueue, "")
+
+	a, _ := l.enter()
+	b, _ := l.enter()
+	c, _ := l.enter()
+
+	bDone := make(chan struct{})
+	cDone := make(chan struct{})
+	go func() {
+		if err := b.wait(); err != nil {
+			t.Error(err)
+		}
+		close(bDone)
+	}()
+	go func() {
+		<-bDone
+		if err := c.wait(); err != nil {
+			t.Error(err)
+		}
+		close(cDone)
+	}()
+
+	if waitDone(bDone) {
+		t.Fatal("queued run admitted while the slot is taken")
+	}
+
+	// Releasing a slot hands it to the first queued run.
+	a.release(&executor.Result{})
+	if !waitDone(bDone) {
+		t.Fatal("first queued run not admitted after release")
+	}
+	if waitDone(cDone) {
+		t.Fatal("second queued run admitted before the first released")
+	}
+	if running, queued := l.state(); running != 1 || queued != 1 {
+		t.Errorf("running %d, queued %d; want 1, 1", running, queued)
+	}
+
+	b.release(&executor.Result{})
+	if !waitDone(cDone) {
+		t.Fatal("second queued run not admitted after release")
+	}
+	c.release(&executor.Result{})
+	if running, queued := l.state(); running != 0 || queued != 0 {
+		t.Errorf("running %d, queued %d; want 0, 0", running, queued)
+	}
+}
+
+func TestLimiterCoalesce(t *testing.T) {
+	l := testLimiter(t, 1, 0, policyCoalesce, "")
+
+	a, _ := l.enter()
+	b, _ := l.enter()
+	c, _ := l.enter()
+	if c.share != b.own {
+		t.Fatal("coalesced run does not share the queued run's result")
+	}
+
+	a.release(&executor.Result{ExitCode: 1})
+	if err := b.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the queued run is admitted, a new run queues again rather than
+	// sharing the result of a run that started before it arrived.
+	d, _ := l.enter()
+	if got := outcome(d, nil); got != "queued" || d.own == b.own {
+		t.Fatalf("run after admission: %s with the same share; want queued with its own", got)
+	}
+
+	b.release(&executor.Result{ExitCode: 2})
+	if res := c.share.wait(); res.ExitCode != 2 {
+		t.Errorf("coalesced run received exit code %d, want 2", res.ExitCode)
+	}
+
+	if err := d.wait(); err != nil {
+		t.Fatal(err)
+	}
+	d.release(&executor.Result{})
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	for _, policy := range []string{policyQueue, policyCoalesce} {
+		t.Run(policy, func(t *testing.T) {
+			l := testLimiter(t, 1, 10, policy, "10ms")
+
+			a, _ := l.enter()
+			b, _ := l.enter()
+			c, _ := l.enter()
+
+			err := b.wait()
+			le, ok := err.(*limitError)
+			if !ok || le.msg != "Timed out waiting to run." || le.status != http.StatusTooManyRequests {
+				t.Fatalf("wait = %v, want a timeout", err)
+			}
+
+			if policy == policyCoalesce {
+				res := c.share.wait()
+				if res.Err != err {
+					t.Errorf("coalesced run received %v, want the timeout", res.Err)
+				}
+			} else if err := c.wait(); err == nil {
+				t.Error("second queued run admitted while the slot is taken")
+			}
+
+			a.release(&executor.Result{})
+			if running, queued := l.state(); running != 0 || queued != 0 {
+				t.Errorf("running %d, queued %d; want 0, 0", running, queued)
+			}
+			if l.pending != nil {
+				t.Error("timed out run is still pending")
+			}
+		})
+	}
+}
+
+// TestLimiterTimeoutHandover checks that a run whose slot is handed over as
+// its queue timeout fires is admitted and keeps the slot.
+func TestLimiterTimeoutHandover(t *testing.T) {
+	l := testLimiter(t, 1, 10, policyQueue, "1ns")
+
+	for i := 0; i < 100; i++ {
+		a, _ := l.enter()
+		b, _ := l.enter()
+
+		a.release(&executor.Result{})
+		if err := b.wait(); err != nil {
+			t.Fatalf("run %d: wait = %v after the slot was handed over", i, err)
+		}
+		if running, queued := l.state(); running != 1 || queued != 0 {
+			t.Fatalf("run %d: running %d, queued %d; want 1, 0", i, running, queued)
+		}
+		b.release(&executor.Result{})
+	}
+
+	if running, _ := l.state(); running != 0 {
+		t.Errorf("running %d after all runs released, want 0", running)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// taskCredential returns the credential the task command runs as.  The user
+// and group attributes of the task override those of the service.  If neither
+// names a user or group, nil is returned and the command runs as the webhook
+// process's user.
+func (s *Server) taskCredential(t config.Task) (*executor.Credential, error) {
+	user, group := s.conf.User, s.conf.Group
+	if t.User != nil {
+		user = t.User
+	}
+	if t.Group != nil {
+		group = t.Group
+	}
+	return lookupCredential(user, group)
+}
+
+func lookupCredential(user, group *string) (*executor.Credential, error) {
+	var u, g string
+	if user != nil {
+		u = *user
+	}
+	if group != nil {
+		g = *group
+	}
+	if u == "" && g == "" {
+		return nil, nil
+	}
+	return executor.LookupCredential(u, g)
+}
+
+// checkCredentials resolves the users and groups named by the service and by
+// the task blocks of its hooks, so that unknown names are reported at startup
+// rather than on the first request.  Task attributes that refer to request
+// data cannot be checked until the task runs and are skipped.
+func checkCredentials(conf config.Service) error {
+	if _, err := lookupCredential(conf.User, conf.Group); err != nil {
+		return fmt.Errorf("service: %s", err)
+	}
+
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "user"},
+			{Name: "group"},
+		},
+	}
+
+	for _, h := range conf.Hooks {
+		content, _, diags := h.PreExecConfig.PartialContent(&hcl.BodySchema{
+			Blocks: []hcl.BlockHeaderSchema{{Type: "task"}},
+		})
+		if diags.HasErrors() {
+			return diags
+		}
+
+		for _, b := range content.Blocks {
+			task, _, diags := b.Body.PartialContent(schema)
+			if diags.HasErrors() {
+				return diags
+			}
+
+			user, err := constantString(task.Attributes["user"])
+			if err != nil {
+				return err
+			}
+			group, err := constantString(task.Attributes["group"])
+			if err != nil {
+				return err
+			}
+
+			if user != nil {
+				if _, err := lookupCredential(user, nil); err != nil {
+					return fmt.Errorf("hook %q: %s", h.ID, err)
+				}
+			}
+			if group != nil {
+				if _, err := lookupCredential(nil, group); err != nil {
+					return fmt.Errorf("hook %q: %s", h.ID, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// constantValue returns the value of expr if it does not depend on the
+// request.  Expressions that refer to variables, or that fail without request
+// data (such as calls to payload), are left to be evaluated when the hook runs
+// and reported as not constant.
+func constantValue(expr hcl.Expression) (cty.Value, bool) {
+	if len(expr.Variables()) > 0 {
+		return cty.NilVal, false
+	}
+
+	v, diags := expr.Value(config.NewContext().EvalContext)
+	if diags.HasErrors() || !v.IsWhollyKnown() {
+		return cty.NilVal, false
+	}
+	return v, true
+}
+
+// constantString returns the value of attr if it is a string that does not
+// depend on the request; see constantValue.  Otherwise, nil is returned.
+func constantString(attr *hcl.Attribute) (*string, error) {
+	if attr == nil {
+		return nil, nil
+	}
+	v, ok := constantValue(attr.Expr)
+	if !ok {
+		return nil, nil
+	}
+
+	v, err := convert.Convert(v, cty.String)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", attr.Range, attr.Name, err)
+	}
+	if v.IsNull() {
+		return nil, nil
+	}
+
+	s := v.AsString()
+	return &s, nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// debouncer collapses the runs of a hook that share a key into the run of the
+// latest request.
+type debouncer struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	bursts map[string]*burst
+}
+
+// burst is a series of requests with the same key, each arriving within the
+// window of the previous one.
+type burst struct {
+	share *share
+	turn  chan bool // of the latest request
+}
+
+// newDebouncers returns the debouncer of each hook with a debounce block.
+func newDebouncers(hooks []config.Hook) (map[string]*debouncer, error) {
+	m := make(map[string]*debouncer)
+	for _, h := range hooks {
+		if h.Debounce == nil {
+			continue
+		}
+		d, err := time.ParseDuration(h.Debounce.Window)
+		if err != nil {
+			return nil, fmt.Errorf("hook %q: invalid debounce window: %s", h.ID, err)
+		}
+		m[h.ID] = &debouncer{
+			window: d,
+			bursts: make(map[string]*burst),
+		}
+	}
+	return m, nil
+}
+
+// wait adds a request to the burst of key and blocks until either the window
+// passes without another request, in which case it reports true, or a later
+// request supersedes it.  The returned share receives the result of the
+// burst's run; the request reporting true must publish it.
+func (d *debouncer) wait(key string) (bool, *share) {
+	turn := make(chan bool, 1)
+
+	d.mu.Lock()
+	b := d.bursts[key]
+	if b == nil {
+		b = &burst{share: newShare()}
+		d.bursts[key] = b
+	} else {
+		b.turn <- false
+	}
+	b.turn = turn
+	d.mu.Unlock()
+
+	time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// A later request restarted the window.
+		if b.turn != turn {
+			return
+		}
+		delete(d.bursts, key)
+		turn <- true
+	})
+
+	return <-turn, b.share
+}
+
+// debounceKey evaluates the key of the hook's debounce block.  A null key is
+// the empty string.
+func debounceKey(ctx *config.RequestContext, db *config.Debounce) (string, hcl.Diagnostics) {
+	v, diags := db.Key.Value(ctx.EvalContext)
+	if diags.HasErrors() || v.IsNull() {
+		return "", diags
+	}
+
+	v, err := convert.Convert(v, cty.String)
+	if err != nil || !v.IsKnown() {
+		return "", diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid debounce key",
+			Detail:   "The debounce key must be a string.",
+			Subject:  db.Key.Range().Ptr(),
+		})
+	}
+	return v.AsString(), diags
+}
+
+// debounce waits for the debounce window of the hook, if any.  If a later
+// request supersedes the job, its files are removed and the job finishes with
+// the result of the later request, which is returned.  Otherwise the returned
+// function must be called with the result of the job.
+func (s *Server) debounce(h *config.Hook, jobID, key string, files fileSet) (func(*executor.Result), *executor.Result) {
+	d := s.debouncers[h.ID]
+	if d == nil {
+		return func(*executor.Result) {}, nil
+	}
+
+	run, sh := d.wait(key)
+	if run {
+		return sh.publish, nil
+	}
+
+	files.remove()
+	s.logf("hook %q: job %s: superseded by a later request", h.ID, jobID)
+	res := sh.wait()
+	s.jobs.finish(jobID, res)
+	return nil, res
+}
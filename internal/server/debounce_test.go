@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/executor"
+)
+
+func TestDebouncerWait(t *testing.T) {
+	const window = 100 * time.Millisecond
+
+	type request struct {
+		at    time.Duration // arrival after the start of the test
+		key   string
+		run   bool // whether the request runs rather than being superseded
+		burst int  // requests of the same burst share a result
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"single", []request{
+			{0, "a", true, 0},
+		}},
+		{"superseded", []request{
+			{0, "a", false, 0},
+			{30 * time.Millisecond, "a", false, 0},
+			{60 * time.Millisecond, "a", true, 0},
+		}},
+		{"keys are independent", []request{
+			{0, "a", false, 0},
+			{0, "b", true, 1},
+			{30 * time.Millisecond, "a", true, 0},
+		}},
+		{"new burst after the window", []request{
+			{0, "a", false, 0},
+			{30 * time.Millisecond, "a", true, 0},
+			{300 * time.Millisecond, "a", true, 1},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &debouncer{window: window, bursts: make(map[string]*burst)}
+
+			runs := make([]bool, len(tt.requests))
+			shares := make([]*share, len(tt.requests))
+			var wg sync.WaitGroup
+			for i, r := range tt.requests {
+				wg.Add(1)
+				go func(i int, r request) {
+					defer wg.Done()
+					time.Sleep(r.at)
+					runs[i], shares[i] = d.wait(r.key)
+				}(i, r)
+			}
+			wg.Wait()
+
+			bursts := map[int]*share{}
+			for i, r := range tt.requests {
+				if runs[i] != r.run {
+					t.Errorf("request %d: run = %t, want %t", i, runs[i], r.run)
+				}
+				if sh, ok := bursts[r.burst]; !ok {
+					bursts[r.burst] = shares[i]
+				} else if shares[i] != sh {
+					t.Errorf("request %d does not share the result of its burst", i)
+				}
+			}
+			for b, sh := range bursts {
+				for c, other := range bursts {
+					if b != c && sh == other {
+						t.Errorf("bursts %d and %d share a result", b, c)
+					}
+				}
+			}
+
+			// The run of each burst publishes its result to the
+			// superseded requests.
+			for i, r := range tt.requests {
+				if runs[i] {
+					shares[i].publish(&executor.Result{ExitCode: r.burst})
+				}
+			}
+			for i, r := range tt.requests {
+				if res := shares[i].wait(); res.ExitCode != r.burst {
+					t.Errorf("request %d received the result of burst %d, want %d", i, res.ExitCode, r.burst)
+				}
+			}
+
+			if n := len(d.bursts); n != 0 {
+				t.Errorf("%d bursts left after their windows passed", n)
+			}
+		})
+	}
+}
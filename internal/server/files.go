@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// tempFile is a file created for a task command.
+type tempFile struct {
+	path string
+	dir  string
+	keep bool
+}
+
+// fileSet tracks the files created for a task command.
+type fileSet []tempFile
+
+// remove deletes every file in the set that is not marked to be kept.
+func (fs fileSet) remove() {
+	for _, f := range fs {
+		if f.keep {
+			continue
+		}
+		if err := os.RemoveAll(f.dir); err != nil {
+			log.Printf("error removing %s: %s", f.path, err)
+		}
+	}
+}
+
+// chown changes the owner of every file in the set, and of the directories
+// holding them, so that a command running as another user can read them.
+func (fs fileSet) chown(uid, gid int) error {
+	for _, f := range fs {
+		if err := os.Chown(f.dir, uid, gid); err != nil {
+			return err
+		}
+		if err := os.Chown(f.path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTempFile writes data to a file with the given name in a new temporary
+// directory.
+func writeTempFile(name string, data []byte, keep bool) (tempFile, error) {
+	base := filepath.Base(name)
+	if base == "." || base == string(filepath.Separator) {
+		return tempFile{}, fmt.Errorf("invalid filename %q", name)
+	}
+
+	dir, err := os.MkdirTemp("", "webhook-")
+	if err != nil {
+		return tempFile{}, err
+	}
+
+	f := tempFile{
+		path: filepath.Join(dir, base),
+		dir:  dir,
+		keep: keep,
+	}
+	if err := os.WriteFile(f.path, data, 0600); err != nil {
+		os.RemoveAll(dir)
+		return tempFile{}, err
+	}
+
+	return f, nil
+}
+
+// writePassFile writes the request value selected by the pass_file block to
+// a temporary file.  The file is named by filename, or by the name of the
+// source value if filename is not set.
+func writePassFile(ctx *config.RequestContext, pf *config.PassFile) (tempFile, error) {
+	var s string
+	switch pf.Source {
+	case "payload":
+		v, err := config.LookupPayload(ctx.Request.Payload, pf.Name)
+		if err != nil {
+			return tempFile{}, err
+		}
+		b, err := config.AsBytes(v)
+		if err != nil {
+			return tempFile{}, fmt.Errorf("payload value %q: %s", pf.Name, err)
+		}
+		s = string(b)
+	case "header":
+		s = ctx.Request.Headers[strings.ToLower(pf.Name)]
+	case "url":
+		s = ctx.Request.Params[strings.ToLower(pf.Name)]
+	default:
+		return tempFile{}, fmt.Errorf("invalid source %q", pf.Source)
+	}
+
+	data := []byte(s)
+	if pf.Base64Decode != nil && *pf.Base64Decode {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return tempFile{}, fmt.Errorf("error decoding %q: %s", pf.Name, err)
+		}
+	}
+
+	filename := pf.Name
+	if pf.Filename != nil {
+		filename = *pf.Filename
+	}
+
+	return writeTempFile(filename, data, pf.Keep != nil && *pf.Keep)
+}
+
+// writeCreateFile writes the content of the create_file block to a temporary
+// file.  The file is named by filename, or by the block label if filename is
+// not set.
+func writeCreateFile(f *config.File) (tempFile, error) {
+	data, err := config.AsBytes(f.Content)
+	if err != nil {
+		return tempFile{}, fmt.Errorf("invalid content: %s", err)
+	}
+
+	filename := f.Label
+	if f.Filename != nil {
+		filename = *f.Filename
+	}
+
+	return writeTempFile(filename, data, f.Keep != nil && *f.Keep)
+}
+
+// fileEnvName returns the environment variable exporting the path of a file
+// created for the task.  If envname is not set, HOOK_ followed by the
+// upper-cased block label is used.
+func fileEnvName(envName *string, name string) string {
+	if envName != nil {
+		return *envName
+	}
+
+	return "HOOK_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// fileValue returns the cty object describing a file created for the task.
+func fileValue(f tempFile) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"path": cty.StringVal(f.path),
+	})
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// serveHook runs the pre-exec, task and post-exec stages of a hook for a
+// single request.
+func (s *Server) serveHook(w http.ResponseWriter, r *http.Request, h *config.Hook, vars map[string]string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxRequestSize))
+	if err != nil {
+		log.Printf("hook %q: error reading request body: %s", h.ID, err)
+		if int64(len(body)) >= s.maxRequestSize {
+			http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error reading request body.", http.StatusBadRequest)
+		return
+	}
+
+	ctx, err := s.newRequestContext(r, h, body, vars)
+	if err != nil {
+		log.Printf("hook %q: %s", h.ID, err)
+		http.Error(w, "Error parsing request.", http.StatusBadRequest)
+		return
+	}
+
+	jobID := newJobID()
+	ctx.EvalContext.Variables["job"] = jobValue(jobID)
+
+	/////
+	// Evaluate constraints
+	/////
+
+	var pre config.PreExecConfig
+	diags := gohcl.DecodeBody(h.PreExecConfig, ctx.EvalContext, &pre)
+	if diags.HasErrors() {
+		log.Printf("hook %q: %s", h.ID, diags)
+		http.Error(w, "Error evaluating hook.", http.StatusInternalServerError)
+		return
+	}
+
+	var exec config.ExecConfig
+	diags = gohcl.DecodeBody(pre.ExecConfig, ctx.EvalContext, &exec)
+	if diags.HasErrors() {
+		log.Printf("hook %q: %s", h.ID, diags)
+		http.Error(w, "Error evaluating hook.", http.StatusInternalServerError)
+		return
+	}
+
+	satisfied, traces, diags := ctx.EvalConstraints(pre.Constraints)
+	if diags.HasErrors() {
+		log.Printf("hook %q: %s", h.ID, diags)
+		http.Error(w, "Error evaluating hook.", http.StatusInternalServerError)
+		return
+	}
+
+	if !satisfied {
+		s.logf("hook %q: constraints not satisfied", h.ID)
+		ctx.EvalContext.Variables["unsatisfied"] = s.unsatisfiedValue(h, traces)
+		resp, diags := unsatisfiedResponse(exec.PostExecConfig, ctx)
+		s.writeResponse(w, h, resp, diags)
+		return
+	}
+
+	/////
+	// Execute task
+	/////
+
+	stream, diags := successStream(exec.PostExecConfig, ctx)
+	if diags.HasErrors() {
+		log.Printf("hook %q: %s", h.ID, diags)
+		http.Error(w, "Error evaluating hook response.", http.StatusInternalServerError)
+		return
+	}
+
+	var key string
+	if h.Debounce != nil {
+		key, diags = debounceKey(ctx, h.Debounce)
+		if diags.HasErrors() {
+			log.Printf("hook %q: %s", h.ID, diags)
+			http.Error(w, "Error evaluating hook.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	t, cmd, files, err := s.prepareTask(ctx, exec.Task.Body)
+	if err != nil {
+		log.Printf("hook %q: %s", h.ID, err)
+		ctx.EvalContext.Variables["result"] = resultValue(&executor.Result{ExitCode: -1, Err: err})
+		resp, diags := errorResponse(exec.PostExecConfig, ctx)
+		s.writeResponse(w, h, resp, diags)
+		return
+	}
+
+	if t.Async != nil && *t.Async {
+		if stream {
+			files.remove()
+			log.Printf("hook %q: stream cannot be used with an async task", h.ID)
+			http.Error(w, "Error evaluating hook.", http.StatusInternalServerError)
+			return
+		}
+
+		// Only asynchronous jobs are recorded; the result of a
+		// synchronous job is in its response.
+		if s.conf.JobsToken != nil {
+			s.jobs.add(jobID, h.ID)
+		}
+
+		// The command has not run yet, so the success response is
+		// rendered with the zero values of result.  It is rendered
+		// before the job is queued, so that a job is never run after
+		// an error response.
+		ctx.EvalContext.Variables["result"] = resultValue(&executor.Result{})
+		resp, diags := successResponse(exec.PostExecConfig, ctx)
+		if diags.HasErrors() {
+			files.remove()
+			s.jobs.finish(jobID, &executor.Result{ExitCode: -1, Err: diags})
+			s.writeResponse(w, h, resp, diags)
+			return
+		}
+
+		// Runs wait for the concurrency limits and the debounce
+		// window before they are submitted to the pool, so that they
+		// do not hold a worker meanwhile.
+		submit := func(release, publish func(*executor.Result)) bool {
+			return s.pool.submit(func() {
+				res := s.runTask(h, jobID, cmd)
+				release(res)
+				files.remove()
+				publish(res)
+			})
+		}
+		queueFull := func(release func(*executor.Result)) *executor.Result {
+			files.remove()
+			log.Printf("hook %q: job %s: async queue is full", h.ID, jobID)
+			res := &executor.Result{ExitCode: -1, Err: errQueueFull}
+			s.jobs.finish(jobID, res)
+			release(res)
+			return res
+		}
+		// background waits for a queued run to be admitted.  A full
+		// queue is then only recorded in the job.
+		background := func(a *admission, err error, publish func(*executor.Result)) {
+			release, res := s.admitted(h, jobID, files, a, err)
+			if res == nil && !submit(release, publish) {
+				res = queueFull(release)
+			}
+			if res != nil {
+				publish(res)
+			}
+		}
+
+		if h.Debounce == nil {
+			a, err := s.enter(h)
+			if err != nil {
+				// The run is rejected without waiting.
+				s.admitted(h, jobID, files, a, err)
+				http.Error(w, err.Error(), err.(*limitError).status)
+				return
+			}
+			noop := func(*executor.Result) {}
+			if a.queued() {
+				go background(a, nil, noop)
+			} else if release, _, _ := a.wait(); !submit(release, noop) {
+				queueFull(release)
+				http.Error(w, "Too many queued jobs.", http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			go func() {
+				publish, res := s.debounce(h, jobID, key, files)
+				if res == nil {
+					a, err := s.enter(h)
+					background(a, err, publish)
+				}
+			}()
+		}
+		s.logf("hook %q: job %s: queued", h.ID, jobID)
+
+		resp.write(w)
+		return
+	}
+
+	var sw *streamWriter
+	publish, res := s.debounce(h, jobID, key, files)
+	if res == nil {
+		res = s.execute(h, jobID, cmd, files, func(cmd *executor.Command) {
+			if stream {
+				sw = newStreamWriter(w, r)
+				cmd.Stdout = sw
+			}
+		})
+		publish(res)
+	}
+
+	if err, ok := res.Err.(*limitError); ok {
+		http.Error(w, err.Error(), err.status)
+		return
+	}
+	if stream {
+		// The response is sent as the command runs, so the response
+		// blocks are not rendered.  If another request ran the
+		// command, its output is sent at once.
+		if sw == nil {
+			sw = newStreamWriter(w, r)
+			sw.Write(res.Stdout)
+		}
+		sw.finish(res)
+		return
+	}
+
+	/////
+	// Send Response
+	/////
+
+	ctx.EvalContext.Variables["result"] = resultValue(res)
+
+	var resp response
+	if res.Err != nil {
+		resp, diags = errorResponse(exec.PostExecConfig, ctx)
+	} else {
+		resp, diags = successResponse(exec.PostExecConfig, ctx)
+	}
+	s.writeResponse(w, h, resp, diags)
+}
+
+// unsatisfiedValue logs the constraints that were not satisfied and returns
+// the cty object exposed as the unsatisfied variable.  Its reasons attribute
+// holds the trace of each failed constraint.
+func (s *Server) unsatisfiedValue(h *config.Hook, traces []*config.Trace) cty.Value {
+	var reasons []cty.Value
+	for _, t := range traces {
+		if t.Satisfied() {
+			continue
+		}
+		s.logf("hook %q: constraint failed:\n%s", h.ID, t.Format(s.conf.Files))
+		reasons = append(reasons, t.CtyValue(s.conf.Dir))
+	}
+
+	v := cty.EmptyTupleVal
+	if len(reasons) > 0 {
+		v = cty.TupleVal(reasons)
+	}
+	return cty.ObjectVal(map[string]cty.Value{
+		"reasons": v,
+	})
+}
+
+// writeResponse writes a rendered response block, or an error if the block
+// could not be evaluated.
+func (s *Server) writeResponse(w http.ResponseWriter, h *config.Hook, resp response, diags hcl.Diagnostics) {
+	if diags.HasErrors() {
+		log.Printf("hook %q: %s", h.ID, diags)
+		http.Error(w, "Error evaluating hook response.", http.StatusInternalServerError)
+		return
+	}
+	resp.write(w)
+}
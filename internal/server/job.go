@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// defaultJobHistory is the number of jobs retained by the job status API if
+// the service does not set job_history.
+const defaultJobHistory = 100
+
+// jobsPath is the path prefix of the job status API.  Hook paths under it are
+// reserved.
+const jobsPath = "/_jobs/"
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// newJobID returns a random identifier for a hook execution.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// jobValue returns the cty object exposed as the job variable.
+func jobValue(id string) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"id": cty.StringVal(id),
+	})
+}
+
+// jobStatus is the state of a single hook execution as reported by the job
+// status API.
+type jobStatus struct {
+	ID         string     `json:"id"`
+	Hook       string     `json:"hook"`
+	State      string     `json:"state"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	PID        int        `json:"pid,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	TimedOut   bool       `json:"timed_out"`
+	Truncated  bool       `json:"truncated"`
+	Error      string     `json:"error,omitempty"`
+	Stdout     string     `json:"stdout"`
+	Stderr     string     `json:"stderr"`
+	Combined   string     `json:"combined"`
+}
+
+// jobStore retains the status of the most recent jobs in a ring buffer.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*jobStatus
+	ring []string
+	next int
+}
+
+// newJobStore returns a store retaining up to size jobs.  A store of size
+// zero retains nothing.
+func newJobStore(size int) *jobStore {
+	return &jobStore{
+		jobs: make(map[string]*jobStatus, size),
+		ring: make([]string, size),
+	}
+}
+
+// add records a newly queued job, evicting the oldest job if the store is
+// full.
+func (js *jobStore) add(id, hook string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if len(js.ring) == 0 {
+		return
+	}
+
+	if old := js.ring[js.next]; old != "" {
+		delete(js.jobs, old)
+	}
+	js.ring[js.next] = id
+	js.next = (js.next + 1) % len(js.ring)
+
+	js.jobs[id] = &jobStatus{
+		ID:       id,
+		Hook:     hook,
+		State:    jobQueued,
+		QueuedAt: time.Now(),
+	}
+}
+
+// start marks the job as running.
+func (js *jobStore) start(id string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if j, ok := js.jobs[id]; ok {
+		now := time.Now()
+		j.State = jobRunning
+		j.StartedAt = &now
+	}
+}
+
+// finish records the result of the job.
+func (js *jobStore) finish(id string, res *executor.Result) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	j.FinishedAt = &now
+	j.State = jobSucceeded
+	if res.Err != nil {
+		j.State = jobFailed
+		j.Error = res.Err.Error()
+	}
+	if j.StartedAt == nil && !res.Started.IsZero() {
+		started := res.Started
+		j.StartedAt = &started
+	}
+	exitCode := res.ExitCode
+	j.ExitCode = &exitCode
+	j.PID = res.PID
+	j.TimedOut = res.TimedOut
+	j.Truncated = res.Truncated
+	j.Stdout = string(res.Stdout)
+	j.Stderr = string(res.Stderr)
+	j.Combined = string(res.Combined)
+}
+
+// get returns a copy of the job's status.
+func (js *jobStore) get(id string) (jobStatus, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	return *j, true
+}
+
+// reservedPath reports whether the hook path p is reserved for the job status
+// API.
+func reservedPath(p string) bool {
+	return p+"/" == jobsPath || strings.HasPrefix(p, jobsPath)
+}
+
+// checkJobsToken validates the jobs_token of the service.
+func checkJobsToken(conf config.Service) error {
+	if conf.JobsToken != nil && *conf.JobsToken == "" {
+		return fmt.Errorf("jobs_token must not be empty")
+	}
+	return nil
+}
+
+// authorizedJobs reports whether the request carries the bearer token of the
+// job status API.
+func (s *Server) authorizedJobs(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(auth, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*s.conf.JobsToken)) == 1
+}
+
+// serveJob reports the status of the job named by the request path as JSON.
+// Only asynchronous jobs are recorded.  The API is disabled unless the service
+// sets jobs_token, which requests must present as a bearer token.
+func (s *Server) serveJob(w http.ResponseWriter, r *http.Request) {
+	if s.conf.JobsToken == nil {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+	if !s.authorizedJobs(r) {
+		s.logf("job status request from %s without a valid token", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jobs"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, jobsPath)
+	j, ok := s.jobs.get(id)
+	if !ok {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(j)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+)
+
+// sizeUnits maps the unit suffixes accepted by parseSize to their sizes in
+// bytes.
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+}
+
+// parseSize parses a size in bytes, optionally followed by a unit such as
+// "KB" or "MiB".
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in size %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	size := n * float64(unit)
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("size %q too large", s)
+	}
+	return uint64(size), nil
+}
+
+// outputLimit parses the named output limit, returning def if it is not set.
+func outputLimit(name string, s *string, def int) (int, error) {
+	if s == nil {
+		return def, nil
+	}
+
+	n, err := parseSize(*s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s limit: %s", name, err)
+	}
+	if n == 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%s limit must be between 1 byte and 2GiB", name)
+	}
+	return int(n), nil
+}
+
+// newLimits converts the limits block of a task to executor limits.  The
+// clear_env attribute is returned separately.
+func newLimits(l *config.Limits) (executor.Limits, bool, error) {
+	var lim executor.Limits
+	if l == nil {
+		return lim, false, nil
+	}
+
+	if l.Memory != nil {
+		n, err := parseSize(*l.Memory)
+		if err != nil {
+			return lim, false, fmt.Errorf("invalid memory limit: %s", err)
+		}
+		lim.Memory = n
+	}
+	if l.CPUTime != nil {
+		d, err := time.ParseDuration(*l.CPUTime)
+		if err != nil {
+			return lim, false, fmt.Errorf("invalid cpu_time limit: %s", err)
+		}
+		lim.CPUTime = d
+	}
+	if l.OpenFiles != nil {
+		if *l.OpenFiles < 0 {
+			return lim, false, fmt.Errorf("open_files limit must not be negative")
+		}
+		lim.OpenFiles = uint64(*l.OpenFiles)
+	}
+	if l.Processes != nil {
+		if *l.Processes < 0 {
+			return lim, false, fmt.Errorf("processes limit must not be negative")
+		}
+		lim.Processes = uint64(*l.Processes)
+	}
+
+	output, err := outputLimit("output", l.Output, 0)
+	if err != nil {
+		return lim, false, err
+	}
+	if lim.Stdout, err = outputLimit("stdout", l.Stdout, output); err != nil {
+		return lim, false, err
+	}
+	if lim.Stderr, err = outputLimit("stderr", l.Stderr, output); err != nil {
+		return lim, false, err
+	}
+	if lim.Combined, err = outputLimit("combined", l.Combined, output); err != nil {
+		return lim, false, err
+	}
+
+	if l.KeepOutput != nil {
+		switch *l.KeepOutput {
+		case "head":
+			lim.OutputHead = true
+		case "tail":
+		default:
+			return lim, false, fmt.Errorf("keep_output must be \"head\" or \"tail\"")
+		}
+	}
+
+	return lim, l.ClearEnv != nil && *l.ClearEnv, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import "errors"
+
+// defaultAsyncWorkers is the number of workers running asynchronous tasks if
+// the service does not set async_workers.
+const defaultAsyncWorkers = 4
+
+// asyncQueueSize is the number of asynchronous tasks that may wait for a free
+// worker before new tasks are rejected.
+const asyncQueueSize = 100
+
+// errQueueFull is recorded for jobs rejected because the queue is full.
+var errQueueFull = errors.New("async queue is full")
+
+// pool runs functions on a fixed number of worker goroutines.
+type pool struct {
+	queue chan func()
+}
+
+func newPool(workers int) *pool {
+	p := &pool{
+		queue: make(chan func(), asyncQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *pool) work() {
+	for f := range p.queue {
+		f()
+	}
+}
+
+// submit queues f to run on a worker.  It returns false without blocking if
+// the queue is full.
+func (p *pool) submit(f func()) bool {
+	select {
+	case p.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
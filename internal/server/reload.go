@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+// active dispatches each request to the server of the most recently loaded
+// configuration.  A request is served to completion by the server it was
+// dispatched to, even if the configuration is reloaded meanwhile.
+type active struct {
+	v atomic.Value // *Server
+}
+
+func (a *active) load() *Server {
+	return a.v.Load().(*Server)
+}
+
+func (a *active) store(s *Server) {
+	a.v.Store(s)
+}
+
+func (a *active) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.load().ServeHTTP(w, r)
+}
+
+// Reload validates conf and returns a Server for it that replaces s for new
+// requests.  If conf is invalid, s keeps serving and the error is returned.
+//
+// The worker pool and the job store are carried over, as are the concurrency
+// limiters and debouncers whose settings are unchanged, so that limits hold
+// across the reload.  Service settings that only take effect on restart are
+// logged if they changed.
+func (s *Server) Reload(conf config.Service) (*Server, error) {
+	next, err := newServer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	next.pool = s.pool
+	next.jobs = s.jobs
+	next.active = s.active
+
+	if next.limits.sameAs(s.limits) {
+		next.limits = s.limits
+	}
+	for id, l := range next.hookLimits {
+		if l.sameAs(s.hookLimits[id]) {
+			next.hookLimits[id] = s.hookLimits[id]
+		}
+	}
+	for id, d := range next.debouncers {
+		if old := s.debouncers[id]; old != nil && old.window == d.window {
+			next.debouncers[id] = old
+		}
+	}
+
+	s.logRestartRequired(conf)
+	s.logHookChanges(next)
+
+	s.active.store(next)
+	return next, nil
+}
+
+// logRestartRequired logs the service settings changed by conf that do not
+// take effect until the service is restarted.
+func (s *Server) logRestartRequired(conf config.Service) {
+	settings := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"ip", s.conf.IP, conf.IP},
+		{"port", s.conf.Port, conf.Port},
+		{"secure", s.conf.Secure, conf.Secure},
+		{"tls_certificate", s.conf.TLSCertificate, conf.TLSCertificate},
+		{"tls_certificate_key", s.conf.TLSCertificateKey, conf.TLSCertificateKey},
+		{"logfile", s.conf.LogFile, conf.LogFile},
+		{"async_workers", s.conf.AsyncWorkers, conf.AsyncWorkers},
+		{"job_history", s.conf.JobHistory, conf.JobHistory},
+		{"read_timeout", s.conf.ReadTimeout, conf.ReadTimeout},
+	}
+	for _, st := range settings {
+		if !reflect.DeepEqual(st.old, st.new) {
+			log.Printf("reload: %s changed; restart to apply", st.name)
+		}
+	}
+}
+
+// logHookChanges logs the hooks added, removed and changed by next.  A hook
+// is changed if the source text of its block differs.
+func (s *Server) logHookChanges(next *Server) {
+	old := make(map[string][]byte, len(s.conf.Hooks))
+	for i := range s.conf.Hooks {
+		h := &s.conf.Hooks[i]
+		old[h.ID] = h.Source(s.conf.Files)
+	}
+
+	var added, removed, changed int
+	seen := make(map[string]bool, len(next.conf.Hooks))
+	for i := range next.conf.Hooks {
+		h := &next.conf.Hooks[i]
+		seen[h.ID] = true
+		src, ok := old[h.ID]
+		switch {
+		case !ok:
+			added++
+			log.Printf("reload: hook %q added at %s", h.ID, hookPath(h.ID))
+		case !bytes.Equal(src, h.Source(next.conf.Files)):
+			changed++
+			log.Printf("reload: hook %q changed", h.ID)
+		}
+	}
+	for _, h := range s.conf.Hooks {
+		if !seen[h.ID] {
+			removed++
+			log.Printf("reload: hook %q removed", h.ID)
+		}
+	}
+
+	log.Printf("reload: configuration reloaded; %d hooks added, %d removed, %d changed", added, removed, changed)
+}
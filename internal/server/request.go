@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// newRequestContext returns an evaluation context populated with the data of
+// the incoming request.  vars holds the values of the hook's path variables.
+// The context is a child of the server's shared context, so it may be used
+// concurrently with those of other requests.
+func (s *Server) newRequestContext(r *http.Request, h *config.Hook, body []byte, vars map[string]string) (*config.RequestContext, error) {
+	req := &config.RequestData{
+		Path:    vars,
+		Headers: make(map[string]string, len(r.Header)),
+	}
+
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			req.Headers[strings.ToLower(k)] = v[0]
+		}
+	}
+
+	query := r.URL.Query()
+	req.Params = make(map[string]string, len(query))
+	for k, v := range query {
+		if len(v) > 0 {
+			req.Params[strings.ToLower(k)] = v[0]
+		}
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if h.Request != nil && h.Request.IncomingPayloadContentType != nil {
+		contentType = *h.Request.IncomingPayloadContentType
+	}
+
+	v, err := config.ParsePayload(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Request != nil && h.Request.JSONStringParameters != nil {
+		v, err = config.DecodeJSONParameters(v, *h.Request.JSONStringParameters)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Payload = v
+
+	ctx := s.ctx.NewRequestContext(req)
+	ctx.EvalContext.Variables["request"] = requestValue(r)
+	ctx.EvalContext.Variables["payload"] = config.BytesVal(body)
+	ctx.EvalContext.Variables["path"] = pathValue(vars)
+
+	return ctx, nil
+}
+
+// requestValue converts the request metadata to the cty object exposed as the
+// request variable.
+func requestValue(r *http.Request) cty.Value {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"method":    cty.StringVal(r.Method),
+		"proto":     cty.StringVal(r.Proto),
+		"host":      cty.StringVal(r.Host),
+		"remote_ip": cty.StringVal(remoteIP),
+	})
+}
+
+// pathValue converts the path variables to the cty object exposed as the path
+// variable.
+func pathValue(vars map[string]string) cty.Value {
+	if len(vars) == 0 {
+		return cty.EmptyObjectVal
+	}
+
+	m := make(map[string]cty.Value, len(vars))
+	for k, v := range vars {
+		m[k] = cty.StringVal(v)
+	}
+	return cty.ObjectVal(m)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+// response is the rendered form of one of the response sub-blocks.
+type response struct {
+	StatusCode  int
+	ContentType string
+	Body        string
+	Headers     map[string]string
+}
+
+func (r response) write(w http.ResponseWriter) {
+	if r.StatusCode < 100 || r.StatusCode > 999 {
+		log.Printf("invalid response status code %d", r.StatusCode)
+		http.Error(w, "Invalid response status code.", http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range r.Headers {
+		w.Header().Set(k, v)
+	}
+	if r.ContentType != "" {
+		w.Header().Set("Content-Type", r.ContentType)
+	}
+	w.WriteHeader(r.StatusCode)
+	io.WriteString(w, r.Body)
+}
+
+func newResponse(defaultStatus int, defaultBody string, statusCode *int, contentType, body *string, headers *map[string]string) response {
+	r := response{
+		StatusCode: defaultStatus,
+		Body:       defaultBody,
+	}
+	if statusCode != nil {
+		r.StatusCode = *statusCode
+	}
+	if contentType != nil {
+		r.ContentType = *contentType
+	}
+	if body != nil {
+		r.Body = *body
+	}
+	if headers != nil {
+		r.Headers = *headers
+	}
+	return r
+}
+
+// responseBlock returns the body of the named sub-block of the response block
+// in the post-exec config, or nil if there is none.
+func responseBlock(body hcl.Body, name string) (hcl.Body, hcl.Diagnostics) {
+	content, diags := body.Content(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "response"}},
+	})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if len(content.Blocks) == 0 {
+		return nil, nil
+	}
+	if diags := checkDuplicateBlocks(content.Blocks); diags.HasErrors() {
+		return nil, diags
+	}
+
+	content, diags = content.Blocks[0].Body.Content(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{Type: "success"},
+			{Type: "error"},
+			{Type: "unsatisfied"},
+		},
+	})
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if diags := checkDuplicateBlocks(content.Blocks); diags.HasErrors() {
+		return nil, diags
+	}
+
+	for _, b := range content.Blocks {
+		if b.Type == name {
+			return b.Body, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkDuplicateBlocks returns an error for each block whose type appears
+// earlier in blocks.
+func checkDuplicateBlocks(blocks hcl.Blocks) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	seen := map[string]*hcl.Block{}
+	for _, b := range blocks {
+		if prev, ok := seen[b.Type]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Duplicate %s block", b.Type),
+				Detail:   fmt.Sprintf("Only one %s block is allowed. Another was defined at %s.", b.Type, prev.DefRange),
+				Subject:  &b.DefRange,
+			})
+			continue
+		}
+		seen[b.Type] = b
+	}
+	return diags
+}
+
+func successResponse(body hcl.Body, ctx *config.RequestContext) (response, hcl.Diagnostics) {
+	r := newResponse(http.StatusOK, "", nil, nil, nil, nil)
+
+	rb, diags := responseBlock(body, "success")
+	if diags.HasErrors() || rb == nil {
+		return r, diags
+	}
+
+	var b config.ResponseSuccess
+	if diags := gohcl.DecodeBody(rb, ctx.EvalContext, &b); diags.HasErrors() {
+		return r, diags
+	}
+	return newResponse(http.StatusOK, "", b.StatusCode, b.ContentType, b.Body, b.Headers), nil
+}
+
+func errorResponse(body hcl.Body, ctx *config.RequestContext) (response, hcl.Diagnostics) {
+	const msg = "Error occurred while executing the hook's command. Please check your logs for more details."
+	r := newResponse(http.StatusInternalServerError, msg, nil, nil, nil, nil)
+
+	rb, diags := responseBlock(body, "error")
+	if diags.HasErrors() || rb == nil {
+		return r, diags
+	}
+
+	var b config.ResponseError
+	if diags := gohcl.DecodeBody(rb, ctx.EvalContext, &b); diags.HasErrors() {
+		return r, diags
+	}
+	return newResponse(http.StatusInternalServerError, msg, b.StatusCode, b.ContentType, b.Body, b.Headers), nil
+}
+
+func unsatisfiedResponse(body hcl.Body, ctx *config.RequestContext) (response, hcl.Diagnostics) {
+	const msg = "Hook rules were not satisfied."
+	r := newResponse(http.StatusOK, msg, nil, nil, nil, nil)
+
+	rb, diags := responseBlock(body, "unsatisfied")
+	if diags.HasErrors() || rb == nil {
+		return r, diags
+	}
+
+	var b config.ResponseUnsatisfied
+	if diags := gohcl.DecodeBody(rb, ctx.EvalContext, &b); diags.HasErrors() {
+		return r, diags
+	}
+	return newResponse(http.StatusOK, msg, b.StatusCode, b.ContentType, b.Body, b.Headers), nil
+}
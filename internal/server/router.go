@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+// router maps request paths to hooks.  Hook IDs may contain {name} segments,
+// which match a single path segment, and a trailing {name...} segment, which
+// matches the remainder of the path.  A templated hook ID that an earlier one
+// matches in every case, such as a/{y} after a/{x}, is an error.
+type router struct {
+	static map[string]*config.Hook
+	routes []*route
+}
+
+type route struct {
+	hook     *config.Hook
+	segments []segment
+}
+
+type segment struct {
+	literal string
+	name    string
+	rest    bool
+}
+
+func newRouter(hooks []config.Hook) (*router, error) {
+	rt := &router{
+		static: make(map[string]*config.Hook, len(hooks)),
+	}
+
+	for i := range hooks {
+		h := &hooks[i]
+
+		r, err := parseRoute(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if r == nil {
+			p := hookPath(h.ID)
+			if reservedPath(p) {
+				return nil, fmt.Errorf("hook %q: path %s is reserved for the job status API", h.ID, p)
+			}
+			if _, ok := rt.static[p]; ok {
+				return nil, fmt.Errorf("hook %q: duplicate hook path %s", h.ID, p)
+			}
+			rt.static[p] = h
+			continue
+		}
+		if s := r.segments[0]; s.literal != "" && reservedPath("/"+s.literal) {
+			return nil, fmt.Errorf("hook %q: path %s is reserved for the job status API", h.ID, hookPath(h.ID))
+		}
+		for _, prev := range rt.routes {
+			if prev.covers(r) {
+				return nil, fmt.Errorf("hook %q: path %s is shadowed by hook %q", h.ID, hookPath(h.ID), prev.hook.ID)
+			}
+		}
+		rt.routes = append(rt.routes, r)
+	}
+
+	return rt, nil
+}
+
+// covers reports whether r matches every path that o matches, in which case o
+// is never matched if r is tried first.
+func (r *route) covers(o *route) bool {
+	for i, seg := range r.segments {
+		if i >= len(o.segments) {
+			return false
+		}
+		other := o.segments[i]
+
+		switch {
+		case seg.rest:
+			return true
+		case seg.name != "":
+			// A variable matches a single non-empty segment.
+			if other.rest || (other.name == "" && other.literal == "") {
+				return false
+			}
+		case other.name != "" || other.literal != seg.literal:
+			return false
+		}
+	}
+	return len(o.segments) == len(r.segments) && !o.segments[len(o.segments)-1].rest
+}
+
+// parseRoute parses the hook ID into a route.  A nil route is returned if the
+// ID does not contain any variables.
+func parseRoute(h *config.Hook) (*route, error) {
+	p := hookPath(h.ID)
+	if !strings.Contains(p, "{") {
+		return nil, nil
+	}
+
+	r := &route{hook: h}
+	seen := map[string]bool{}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("hook %q: invalid path segment %q: variables must span the entire segment", h.ID, part)
+			}
+			r.segments = append(r.segments, segment{literal: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		seg := segment{name: name}
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("hook %q: %q must be the final path segment", h.ID, part)
+			}
+			seg.name = strings.TrimSuffix(name, "...")
+			seg.rest = true
+		}
+
+		if !hclsyntax.ValidIdentifier(seg.name) {
+			return nil, fmt.Errorf("hook %q: invalid path variable name %q", h.ID, seg.name)
+		}
+		if seen[seg.name] {
+			return nil, fmt.Errorf("hook %q: duplicate path variable %q", h.ID, seg.name)
+		}
+		seen[seg.name] = true
+
+		r.segments = append(r.segments, seg)
+	}
+
+	return r, nil
+}
+
+// match returns the hook for the given escaped path along with the values of
+// any path variables.  Static hook IDs take precedence over templated ones,
+// which are tried in the order they were declared.
+func (rt *router) match(escapedPath string) (*config.Hook, map[string]string) {
+	if p, err := url.PathUnescape(escapedPath); err == nil {
+		if h, ok := rt.static[p]; ok {
+			return h, map[string]string{}
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	for _, r := range rt.routes {
+		if vars, ok := r.match(parts); ok {
+			return r.hook, vars
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *route) match(parts []string) (map[string]string, bool) {
+	vars := make(map[string]string)
+
+	for i, seg := range r.segments {
+		if seg.rest {
+			if i >= len(parts) {
+				return nil, false
+			}
+			v, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			vars[seg.name] = v
+			return vars, true
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		v, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+
+		if seg.name == "" {
+			if v != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+
+		if v == "" {
+			return nil, false
+		}
+		vars[seg.name] = v
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return vars, true
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+func testRouter(t *testing.T, ids ...string) *router {
+	t.Helper()
+	hooks := make([]config.Hook, len(ids))
+	for i, id := range ids {
+		hooks[i].ID = id
+	}
+	rt, err := newRouter(hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestRouterMatch(t *testing.T) {
+	rt := testRouter(t,
+		"static",
+		"PREFIX/webhook/{scan_id}",
+		"repos/{owner}/{name}/hooks",
+		"repos/{owner}/latest",
+		"files/{path...}",
+		"{any}/{thing}",
+	)
+
+	tests := []struct {
+		path string
+		hook string
+		vars map[string]string
+	}{
+		{"/static", "static", map[string]string{}},
+		{"/PREFIX/webhook/42", "PREFIX/webhook/{scan_id}", map[string]string{"scan_id": "42"}},
+		{"/PREFIX/webhook/a%2Fb", "PREFIX/webhook/{scan_id}", map[string]string{"scan_id": "a/b"}},
+		{"/repos/moore/webhook/hooks", "repos/{owner}/{name}/hooks", map[string]string{"owner": "moore", "name": "webhook"}},
+		{"/repos/moore/latest", "repos/{owner}/latest", map[string]string{"owner": "moore"}},
+		{"/files/a/b/c.txt", "files/{path...}", map[string]string{"path": "a/b/c.txt"}},
+		{"/files/", "files/{path...}", map[string]string{"path": ""}},
+		{"/files/a%20b/c", "files/{path...}", map[string]string{"path": "a b/c"}},
+		// Templated routes are tried in the order they were declared.
+		{"/repos/moore", "{any}/{thing}", map[string]string{"any": "repos", "thing": "moore"}},
+
+		{"/", "", nil},
+		{"/missing", "", nil},
+		{"/files", "", nil},
+		{"/PREFIX/webhook/", "", nil},
+		{"/PREFIX/webhook/42/extra", "", nil},
+		{"/repos/moore/webhook/hooks/extra", "", nil},
+		{"/PREFIX/webhook/%zz", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			h, vars := rt.match(tt.path)
+			if tt.hook == "" {
+				if h != nil {
+					t.Fatalf("matched hook %q, want none", h.ID)
+				}
+				return
+			}
+			if h == nil {
+				t.Fatalf("matched no hook, want %q", tt.hook)
+			}
+			if h.ID != tt.hook {
+				t.Errorf("matched hook %q, want %q", h.ID, tt.hook)
+			}
+			if !reflect.DeepEqual(vars, tt.vars) {
+				t.Errorf("vars = %v, want %v", vars, tt.vars)
+			}
+		})
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	tests := []struct {
+		ids []string
+		err string // empty if the hooks are valid
+	}{
+		{[]string{"a", "/a"}, "duplicate hook path /a"},
+		{[]string{"a/{x}", "a/{y}"}, `path /a/{y} is shadowed by hook "a/{x}"`},
+		{[]string{"a/{x...}", "a/{y}/b"}, `path /a/{y}/b is shadowed by hook "a/{x...}"`},
+		{[]string{"{x}/{y}", "a/{z}"}, `path /a/{z} is shadowed by hook "{x}/{y}"`},
+		{[]string{"a/{x...}", "a/{y...}"}, `path /a/{y...} is shadowed by hook "a/{x...}"`},
+		{[]string{"a/{x}", "a/b"}, ""},
+		{[]string{"a/{x}", "{y}/b"}, ""},
+		{[]string{"a/{x}/b", "a/{y...}"}, ""},
+		{[]string{"a/{x}", "a/{y...}"}, ""},
+		{[]string{"a/b/{x}", "a/{y}/c"}, ""},
+
+		{[]string{"_jobs"}, "reserved for the job status API"},
+		{[]string{"_jobs/x"}, "reserved for the job status API"},
+		{[]string{"_jobs/{id}"}, "reserved for the job status API"},
+		{[]string{"a/{x}b"}, "variables must span the entire segment"},
+		{[]string{"a/{x...}/b"}, "must be the final path segment"},
+		{[]string{"a/{1x}"}, "invalid path variable name"},
+		{[]string{"{x}/{x}"}, `duplicate path variable "x"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.ids, ","), func(t *testing.T) {
+			hooks := make([]config.Hook, len(tt.ids))
+			for i, id := range tt.ids {
+				hooks[i].ID = id
+			}
+			_, err := newRouter(hooks)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("no error, want %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("error %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
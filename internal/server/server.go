@@ -0,0 +1,300 @@
+// Package server implements the HTTP listener that dispatches incoming
+// requests to the hook blocks of a service configuration.
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+const (
+	defaultIP   = "0.0.0.0"
+	defaultPort = 9000
+
+	defaultMaxRequestSize = 10 << 20
+	defaultReadTimeout    = time.Minute
+
+	// No write timeout is set, as synchronous tasks may run and stream
+	// their output for as long as they take.
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// Server serves the hooks of a single service configuration.
+type Server struct {
+	conf   config.Service
+	ctx    *config.Context
+	router *router
+	pool   *pool
+	jobs   *jobStore
+
+	limits     *limiter
+	hookLimits map[string]*limiter
+	debouncers map[string]*debouncer
+
+	maxRequestSize int64
+
+	// active is shared by the servers of successive configurations and
+	// holds the one serving new requests.
+	active *active
+
+	Debug   bool
+	Verbose bool
+}
+
+// New returns a Server for the given service.  The service's hooks must
+// already be decoded.
+func New(conf config.Service) (*Server, error) {
+	s, err := newServer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	workers, _ := asyncWorkers(conf)
+	s.pool = newPool(workers)
+
+	history, _ := jobHistory(conf)
+	s.jobs = newJobStore(history)
+
+	s.active = new(active)
+	s.active.store(s)
+
+	return s, nil
+}
+
+// newServer validates the service and returns a Server for it without the
+// state shared across reloads: the worker pool, the job store and the active
+// server.
+func newServer(conf config.Service) (*Server, error) {
+	rt, err := newRouter(conf.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCredentials(conf); err != nil {
+		return nil, err
+	}
+	if err := checkStream(conf); err != nil {
+		return nil, err
+	}
+	if _, err := asyncWorkers(conf); err != nil {
+		return nil, err
+	}
+	if _, err := jobHistory(conf); err != nil {
+		return nil, err
+	}
+	if err := checkJobsToken(conf); err != nil {
+		return nil, err
+	}
+	maxSize, err := maxRequestSize(conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readTimeout(conf); err != nil {
+		return nil, err
+	}
+
+	sl, hl, err := newLimiters(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	debouncers, err := newDebouncers(conf.Hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range conf.Hooks {
+		h := &conf.Hooks[i]
+		for _, d := range h.CheckLogicalCalls() {
+			log.Printf("hook %q: warning: %s", h.ID, d.Error())
+		}
+	}
+
+	s := &Server{
+		conf:       conf,
+		router:     rt,
+		limits:     sl,
+		hookLimits: hl,
+		debouncers: debouncers,
+
+		maxRequestSize: maxSize,
+	}
+
+	if conf.Debug != nil {
+		s.Debug = *conf.Debug
+	}
+	if conf.Verbose != nil {
+		s.Verbose = *conf.Verbose
+	}
+
+	s.ctx = config.NewContext()
+	s.ctx.Debug = s.Debug
+
+	return s, nil
+}
+
+// asyncWorkers returns the number of workers running asynchronous tasks.
+func asyncWorkers(conf config.Service) (int, error) {
+	workers := defaultAsyncWorkers
+	if conf.AsyncWorkers != nil {
+		workers = *conf.AsyncWorkers
+	}
+	if workers < 1 {
+		return 0, fmt.Errorf("async_workers must be at least 1")
+	}
+	return workers, nil
+}
+
+// jobHistory returns the number of jobs retained by the job status API.
+func jobHistory(conf config.Service) (int, error) {
+	history := defaultJobHistory
+	if conf.JobHistory != nil {
+		history = *conf.JobHistory
+	}
+	if history < 0 {
+		return 0, fmt.Errorf("job_history must not be negative")
+	}
+	return history, nil
+}
+
+// maxRequestSize returns the maximum size of a request body in bytes.
+func maxRequestSize(conf config.Service) (int64, error) {
+	if conf.MaxRequestSize == nil {
+		return defaultMaxRequestSize, nil
+	}
+	n, err := parseSize(*conf.MaxRequestSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max_request_size: %s", err)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("max_request_size must be at least 1 byte")
+	}
+	return int64(n), nil
+}
+
+// readTimeout returns the time allowed to read a request.
+func readTimeout(conf config.Service) (time.Duration, error) {
+	if conf.ReadTimeout == nil {
+		return defaultReadTimeout, nil
+	}
+	d, err := time.ParseDuration(*conf.ReadTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid read_timeout: %s", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("read_timeout must be positive")
+	}
+	return d, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	ip := defaultIP
+	if s.conf.IP != nil {
+		ip = *s.conf.IP
+	}
+
+	port := defaultPort
+	if s.conf.Port != nil {
+		port = *s.conf.Port
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// ListenAndServe binds the service address and serves requests until an error
+// occurs.
+func (s *Server) ListenAndServe() error {
+	timeout, _ := readTimeout(s.conf)
+	srv := &http.Server{
+		Addr:              s.Addr(),
+		Handler:           s.active,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       timeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	for _, h := range s.conf.Hooks {
+		s.logf("serving hook %q at %s", h.ID, hookPath(h.ID))
+	}
+
+	if s.conf.Secure != nil && *s.conf.Secure {
+		if s.conf.TLSCertificate == nil || s.conf.TLSCertificateKey == nil {
+			return fmt.Errorf("secure service requires tls_certificate and tls_certificate_key")
+		}
+
+		log.Printf("serving hooks on https://%s", srv.Addr)
+		return srv.ListenAndServeTLS(*s.conf.TLSCertificate, *s.conf.TLSCertificateKey)
+	}
+
+	log.Printf("serving hooks on http://%s", srv.Addr)
+	return srv.ListenAndServe()
+}
+
+// ServeHTTP dispatches the request to the hook mounted at the request path.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.logf("incoming %s request from %s for %s", r.Method, r.RemoteAddr, r.URL.Path)
+
+	if reservedPath(r.URL.Path) {
+		s.serveJob(w, r)
+		return
+	}
+
+	h, vars := s.router.match(r.URL.EscapedPath())
+	if h == nil {
+		http.Error(w, "Hook not found.", http.StatusNotFound)
+		return
+	}
+
+	if !s.methodAllowed(h, r.Method) {
+		s.logf("hook %q: method %s not allowed", h.ID, r.Method)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.serveHook(w, r, h, vars)
+}
+
+// methodAllowed reports whether the hook accepts the given HTTP method.  The
+// hook's request.http_methods takes precedence over the service's
+// http_methods.  If neither is set, all methods are allowed.
+func (s *Server) methodAllowed(h *config.Hook, method string) bool {
+	methods := s.conf.HTTPMethods
+	if h.Request != nil && h.Request.HTTPMethods != nil {
+		methods = h.Request.HTTPMethods
+	}
+	if methods == nil || len(*methods) == 0 {
+		return true
+	}
+
+	for _, m := range *methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Verbose || s.Debug {
+		log.Printf(format, v...)
+	}
+}
+
+func (s *Server) debugf(format string, v ...interface{}) {
+	if s.Debug {
+		log.Printf("DEBUG: "+format, v...)
+	}
+}
+
+// hookPath returns the URL path a hook ID is mounted at.
+func hookPath(id string) string {
+	return "/" + strings.TrimLeft(id, "/")
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Trailers sent at the end of a chunked output stream.
+const (
+	trailerExitCode  = "Webhook-Exit-Code"
+	trailerStatus    = "Webhook-Status"
+	trailerTruncated = "Webhook-Truncated"
+)
+
+// successStream reports whether the success response block sets stream.  The
+// attribute is evaluated before the task runs, so it cannot refer to the
+// result.
+func successStream(body hcl.Body, ctx *config.RequestContext) (bool, hcl.Diagnostics) {
+	rb, diags := responseBlock(body, "success")
+	if diags.HasErrors() || rb == nil {
+		return false, diags
+	}
+
+	content, _, diags := rb.PartialContent(&hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: "stream"}},
+	})
+	if diags.HasErrors() {
+		return false, diags
+	}
+
+	attr, ok := content.Attributes["stream"]
+	if !ok {
+		return false, nil
+	}
+	var stream bool
+	diags = gohcl.DecodeExpression(attr.Expr, ctx.EvalContext, &stream)
+	return stream, diags
+}
+
+// checkStream reports hooks whose success response streams the output of an
+// async task, which runs after the response is sent.  Attributes that depend
+// on the request are checked when the hook runs.
+func checkStream(conf config.Service) error {
+	for _, h := range conf.Hooks {
+		async := nestedAttribute(h.PreExecConfig, "async", "task")
+		stream := nestedAttribute(h.PreExecConfig, "stream", "response", "success")
+		if constantTrue(async) && constantTrue(stream) {
+			return fmt.Errorf("hook %q: %s: stream cannot be used with an async task", h.ID, stream.Range)
+		}
+	}
+	return nil
+}
+
+// nestedAttribute returns the named attribute of the block reached by taking
+// the first block of each type in path, or nil if there is none.  Malformed
+// blocks are reported when the hook runs.
+func nestedAttribute(body hcl.Body, name string, path ...string) *hcl.Attribute {
+	for _, typ := range path {
+		content, _, diags := body.PartialContent(&hcl.BodySchema{
+			Blocks: []hcl.BlockHeaderSchema{{Type: typ}},
+		})
+		if diags.HasErrors() || len(content.Blocks) == 0 {
+			return nil
+		}
+		body = content.Blocks[0].Body
+	}
+
+	content, _, diags := body.PartialContent(&hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: name}},
+	})
+	if diags.HasErrors() {
+		return nil
+	}
+	return content.Attributes[name]
+}
+
+// constantTrue reports whether attr is true without depending on the request;
+// see constantValue.
+func constantTrue(attr *hcl.Attribute) bool {
+	if attr == nil {
+		return false
+	}
+	v, ok := constantValue(attr.Expr)
+	if !ok {
+		return false
+	}
+
+	v, err := convert.Convert(v, cty.Bool)
+	return err == nil && !v.IsNull() && v.True()
+}
+
+// streamWriter sends the standard output of a command to the client as it is
+// produced.  Output is sent as Server-Sent Events if the client accepts them
+// and as a chunked plain text body otherwise.  Write errors, such as those
+// caused by the client disconnecting, are logged once and further output is
+// dropped, so that the command is not interrupted.
+type streamWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+	partial []byte
+	failed  bool
+}
+
+// newStreamWriter sends the response headers for an output stream.
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	sw := &streamWriter{
+		w:   w,
+		sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+	}
+	sw.flusher, _ = w.(http.Flusher)
+
+	h := w.Header()
+	if sw.sse {
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+	} else {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Trailer", strings.Join([]string{trailerExitCode, trailerStatus, trailerTruncated}, ", "))
+	}
+	w.WriteHeader(http.StatusOK)
+	sw.flush()
+
+	return sw
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if !sw.sse {
+		sw.write(p)
+		return len(p), nil
+	}
+
+	// Events are sent per line, so hold back any incomplete line.
+	sw.partial = append(sw.partial, p...)
+	i := bytes.LastIndexByte(sw.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := sw.partial[:i]
+	sw.partial = append([]byte(nil), sw.partial[i+1:]...)
+
+	var buf bytes.Buffer
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteString("\n\n")
+	}
+	sw.write(buf.Bytes())
+
+	return len(p), nil
+}
+
+// finish ends the stream with the outcome of the command, sent as trailers or
+// as a final "result" event.
+func (sw *streamWriter) finish(res *executor.Result) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	status := "success"
+	if res.Err != nil {
+		status = "error"
+	}
+
+	if !sw.sse {
+		h := sw.w.Header()
+		h.Set(trailerExitCode, strconv.Itoa(res.ExitCode))
+		h.Set(trailerStatus, status)
+		h.Set(trailerTruncated, strconv.FormatBool(res.Truncated))
+		return
+	}
+
+	if len(sw.partial) > 0 {
+		sw.write([]byte(fmt.Sprintf("data: %s\n\n", sw.partial)))
+		sw.partial = nil
+	}
+
+	result := struct {
+		Status    string `json:"status"`
+		ExitCode  int    `json:"exit_code"`
+		TimedOut  bool   `json:"timed_out"`
+		Truncated bool   `json:"truncated"`
+		Error     string `json:"error,omitempty"`
+	}{
+		Status:    status,
+		ExitCode:  res.ExitCode,
+		TimedOut:  res.TimedOut,
+		Truncated: res.Truncated,
+	}
+	if res.Err != nil {
+		result.Error = res.Err.Error()
+	}
+
+	b, _ := json.Marshal(result)
+	sw.write([]byte(fmt.Sprintf("event: result\ndata: %s\n\n", b)))
+}
+
+// write sends p to the client.  The caller must hold sw.mu.
+func (sw *streamWriter) write(p []byte) {
+	if sw.failed {
+		return
+	}
+	if _, err := sw.w.Write(p); err != nil {
+		log.Printf("error streaming command output: %s", err)
+		sw.failed = true
+		return
+	}
+	sw.flush()
+}
+
+func (sw *streamWriter) flush() {
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/moorereason/webhook-hcl/internal/config"
+	"github.com/moorereason/webhook-hcl/internal/executor"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// runTask executes the command and logs its outcome.
+func (s *Server) runTask(h *config.Hook, jobID string, cmd executor.Command) *executor.Result {
+	s.logf("hook %q: job %s: executing %q", h.ID, jobID, cmd.Args)
+	s.jobs.start(jobID)
+	res := executor.Run(cmd)
+	s.jobs.finish(jobID, res)
+	if res.Err != nil {
+		log.Printf("hook %q: job %s: command failed: %s", h.ID, jobID, res.Err)
+	}
+	s.logf("hook %q: job %s: command exited with code %d in %s", h.ID, jobID, res.ExitCode, res.Duration)
+	s.debugf("hook %q: job %s: command output: %s", h.ID, jobID, res.Combined)
+
+	return res
+}
+
+// execute runs the command of a job once the concurrency limits admit it and
+// removes the job's files.  start, if set, is called just before the command
+// runs.  If the job is coalesced into a queued run, the result is that of the
+// queued run.  If it is not admitted, the result's Err is a *limitError.
+func (s *Server) execute(h *config.Hook, jobID string, cmd executor.Command, files fileSet, start func(*executor.Command)) *executor.Result {
+	a, err := s.enter(h)
+	release, res := s.admitted(h, jobID, files, a, err)
+	if res != nil {
+		return res
+	}
+
+	if start != nil {
+		start(&cmd)
+	}
+	res = s.runTask(h, jobID, cmd)
+	release(res)
+	files.remove()
+	return res
+}
+
+// prepareTask writes the files of the task block and decodes the remainder of
+// the task into a command.  The path of each file is available to the task as
+// files.<label>.path.  The returned fileSet must be removed once the command
+// completes.  If any file cannot be written, none are left behind.
+func (s *Server) prepareTask(ctx *config.RequestContext, body hcl.Body) (config.Task, executor.Command, fileSet, error) {
+	var t config.Task
+	var files fileSet
+	env := map[string]string{}
+	vals := map[string]cty.Value{}
+
+	var tf config.TaskFiles
+	if diags := gohcl.DecodeBody(body, ctx.EvalContext, &tf); diags.HasErrors() {
+		return t, executor.Command{}, nil, diags
+	}
+
+	add := func(block, label string, envName *string, write func() (tempFile, error)) error {
+		if _, ok := vals[label]; ok {
+			return fmt.Errorf("%s %q: duplicate file label", block, label)
+		}
+		f, err := write()
+		if err != nil {
+			return fmt.Errorf("%s %q: %s", block, label, err)
+		}
+		files = append(files, f)
+		env[fileEnvName(envName, label)] = f.path
+		vals[label] = fileValue(f)
+		return nil
+	}
+
+	for i := range tf.PassFiles {
+		pf := &tf.PassFiles[i]
+		err := add("pass_file", pf.Label, pf.EnvName, func() (tempFile, error) {
+			return writePassFile(ctx, pf)
+		})
+		if err != nil {
+			files.remove()
+			return t, executor.Command{}, nil, err
+		}
+	}
+	for i := range tf.Files {
+		cf := &tf.Files[i]
+		err := add("create_file", cf.Label, cf.EnvName, func() (tempFile, error) {
+			return writeCreateFile(cf)
+		})
+		if err != nil {
+			files.remove()
+			return t, executor.Command{}, nil, err
+		}
+	}
+	ctx.EvalContext.Variables["files"] = cty.ObjectVal(vals)
+
+	diags := gohcl.DecodeBody(tf.Task, ctx.EvalContext, &t)
+	if diags.HasErrors() {
+		files.remove()
+		return t, executor.Command{}, nil, diags
+	}
+	t.PassFiles = tf.PassFiles
+	t.Files = tf.Files
+
+	cmd, err := newCommand(t)
+	if err != nil {
+		files.remove()
+		return t, cmd, nil, err
+	}
+	if cmd.Credential, err = s.taskCredential(t); err != nil {
+		files.remove()
+		return t, cmd, nil, err
+	}
+	if cmd.Credential != nil {
+		if err := files.chown(int(cmd.Credential.UID), int(cmd.Credential.GID)); err != nil {
+			files.remove()
+			return t, cmd, nil, err
+		}
+	}
+
+	for k, v := range cmd.Env {
+		env[k] = v
+	}
+	cmd.Env = env
+
+	return t, cmd, files, nil
+}
+
+// newCommand converts the task block to an executor command.
+func newCommand(t config.Task) (executor.Command, error) {
+	cmd := executor.Command{
+		Args: t.ExecuteCommand,
+	}
+	if len(cmd.Args) == 0 {
+		return cmd, fmt.Errorf("cmd must not be empty")
+	}
+	if t.CommandWorkingDirectory != nil {
+		cmd.Dir = *t.CommandWorkingDirectory
+	}
+	if t.PassEnvironmentToCommand != nil {
+		cmd.Env = *t.PassEnvironmentToCommand
+	}
+	if !t.Stdin.IsNull() {
+		b, err := config.AsBytes(t.Stdin)
+		if err != nil {
+			return cmd, fmt.Errorf("invalid stdin: %s", err)
+		}
+		cmd.Stdin = b
+	}
+
+	if t.Timeout != nil {
+		d, err := time.ParseDuration(*t.Timeout)
+		if err != nil {
+			return cmd, fmt.Errorf("invalid timeout: %s", err)
+		}
+		cmd.Timeout = d
+	}
+	if t.KillGracePeriod != nil {
+		d, err := time.ParseDuration(*t.KillGracePeriod)
+		if err != nil {
+			return cmd, fmt.Errorf("invalid kill_grace_period: %s", err)
+		}
+		cmd.KillGracePeriod = d
+	}
+
+	var err error
+	if cmd.Limits, cmd.ClearEnv, err = newLimits(t.Limits); err != nil {
+		return cmd, err
+	}
+
+	return cmd, nil
+}
+
+// resultValue converts a command result to the cty object exposed as the
+// result variable.  The duration is in nanoseconds, like the values of the
+// duration and since functions.
+func resultValue(res *executor.Result) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"exit_code": cty.NumberIntVal(int64(res.ExitCode)),
+		"pid":       cty.NumberIntVal(int64(res.PID)),
+		"stdout":    cty.StringVal(string(res.Stdout)),
+		"stderr":    cty.StringVal(string(res.Stderr)),
+		"combined":  cty.StringVal(string(res.Combined)),
+		"duration":  cty.NumberIntVal(int64(res.Duration)),
+		"error":     cty.BoolVal(res.Err != nil),
+		"timed_out": cty.BoolVal(res.TimedOut),
+		"truncated": cty.BoolVal(res.Truncated),
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+func TestLoadConfigDirectory(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		hooks []string // IDs of the loaded hooks, in order
+		diags []string // summary and subject of each diagnostic
+		err   string   // error other than diagnostics
+	}{
+		{
+			name: "hooks merged",
+			files: map[string]string{
+				"a.hcl": "port = 9123\nhook \"a\" {\n}\n",
+				"b.hcl": "hook \"b\" {\n}\nhook \"c\" {\n}\n",
+			},
+			hooks: []string{"a", "b", "c"},
+		},
+		{
+			name: "other files ignored",
+			files: map[string]string{
+				"a.hcl":       "hook \"a\" {\n}\n",
+				"notes.txt":   "not hcl {",
+				"a.hcl.bak":   "hook \"a\" {\n}\n",
+				".b.hcl":      "hook \"a\" {\n}\n",
+				"sub/c.hcl":   "hook \"c\" {\n}\n",
+				"README":      "",
+				"hooks.hcl~":  "{",
+				"config.json": "{}",
+			},
+			hooks: []string{"a"},
+		},
+		{
+			name: "duplicate hook",
+			files: map[string]string{
+				"a.hcl": "hook \"a\" {\n}\n",
+				"b.hcl": "\nhook \"b\" {\n}\nhook \"a\" {\n}\n",
+			},
+			diags: []string{
+				"Duplicate hook @ b.hcl:4",
+				"Duplicate hook @ a.hcl:1",
+			},
+		},
+		{
+			name: "service attributes in two files",
+			files: map[string]string{
+				"a.hcl": "port = 9123\nhook \"a\" {\n}\n",
+				"b.hcl": "hook \"b\" {\n}\n\nverbose = true\n",
+			},
+			diags: []string{
+				"Service attributes in multiple files @ b.hcl:4",
+				"Service attributes in multiple files @ a.hcl:1",
+			},
+		},
+		{
+			name:  "no configuration files",
+			files: map[string]string{"notes.txt": ""},
+			err:   "no .hcl files found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, src := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			conf, err := loadConfig(dir)
+
+			if tt.diags != nil {
+				diags, ok := err.(hcl.Diagnostics)
+				if !ok {
+					t.Fatalf("error %v, want diagnostics", err)
+				}
+				var got []string
+				for _, d := range diags {
+					got = append(got, fmt.Sprintf("%s @ %s:%d", d.Summary, filepath.Base(d.Subject.Filename), d.Subject.Start.Line))
+				}
+				if strings.Join(got, "; ") != strings.Join(tt.diags, "; ") {
+					t.Errorf("diagnostics = %q, want %q", got, tt.diags)
+				}
+				return
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, h := range conf.Hooks {
+				got = append(got, h.ID)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.hooks, " ") {
+				t.Errorf("hooks = %q, want %q", got, tt.hooks)
+			}
+			if conf.Dir != dir {
+				t.Errorf("Dir = %q, want %q", conf.Dir, dir)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "webhook.hcl")
+	if err := os.WriteFile(path, []byte("port = 9123\nhook \"a\" {\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Port == nil || *conf.Port != 9123 {
+		t.Errorf("port = %v, want 9123", conf.Port)
+	}
+	if len(conf.Hooks) != 1 || conf.Hooks[0].ID != "a" {
+		t.Errorf("hooks = %v, want [a]", conf.Hooks)
+	}
+	if conf.Dir != dir {
+		t.Errorf("Dir = %q, want %q", conf.Dir, dir)
+	}
+	if _, ok := conf.Files[path]; !ok {
+		t.Errorf("Files does not hold %s", path)
+	}
+}
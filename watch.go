@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/moorereason/webhook-hcl/internal/config"
+)
+
+// pollInterval is how often the configuration files are checked for changes
+// if the service sets hotreload.
+const pollInterval = 2 * time.Second
+
+// watcher polls the configuration for changes.  A nil watcher never fires.
+type watcher struct {
+	path    string
+	ticker  *time.Ticker
+	stats   map[string]fileStat
+	pending bool
+}
+
+// fileStat is the state of a file used to detect changes.  A missing file has
+// the zero fileStat.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// newWatcher returns a watcher for path, the configuration file or directory,
+// or nil if the service does not set hotreload.
+func newWatcher(conf config.Service, path string) *watcher {
+	if conf.HotReload == nil || !*conf.HotReload {
+		return nil
+	}
+	return &watcher{
+		path:   path,
+		ticker: time.NewTicker(pollInterval),
+		stats:  statConfig(path),
+	}
+}
+
+// C returns the channel on which the watcher's ticks are delivered.  Each tick
+// should be followed by a call to poll.
+func (w *watcher) C() <-chan time.Time {
+	if w == nil {
+		return nil
+	}
+	return w.ticker.C
+}
+
+func (w *watcher) stop() {
+	if w != nil {
+		w.ticker.Stop()
+	}
+}
+
+// poll reports whether the configuration has changed and has since been left
+// unchanged for one interval, so that files still being written are not
+// loaded.
+func (w *watcher) poll() bool {
+	stats := statConfig(w.path)
+	changed := len(stats) != len(w.stats)
+	for name, st := range stats {
+		old, ok := w.stats[name]
+		if !ok || !st.modTime.Equal(old.modTime) || st.size != old.size {
+			changed = true
+		}
+	}
+	w.stats = stats
+
+	if changed {
+		w.pending = true
+		return false
+	}
+	if w.pending {
+		w.pending = false
+		return true
+	}
+	return false
+}
+
+// statConfig returns the state of path and, if it is a directory, of each of
+// its configuration files.  The directory is read on every call, so that files
+// are watched whether or not they were loaded successfully.
+func statConfig(path string) map[string]fileStat {
+	stats := map[string]fileStat{path: statFile(path)}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		names, _ := configFiles(path)
+		for _, name := range names {
+			stats[name] = statFile(name)
+		}
+	}
+	return stats
+}
+
+func statFile(name string) fileStat {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStat{}
+	}
+	return fileStat{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+}